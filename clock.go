@@ -0,0 +1,98 @@
+package stm
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// Clock is the source of time of a state machine, set with WithClock.
+	// The commands and options waiting or measuring time follow it, like
+	// Timer, Tick, the timeouts of TimedState or WithMaxLifetime, as well as
+	// the times of the history. The durations reported to the Metrics, the
+	// slow updates reported by WithUpdateTimeout and the deadline of the
+	// context given to the shutdown command always use the real time.
+	Clock interface {
+		// Now returns the current time.
+		Now() time.Time
+		// NewTimer creates a timer firing once after d.
+		NewTimer(d time.Duration) ClockTimer
+		// NewTicker creates a ticker firing every d.
+		NewTicker(d time.Duration) ClockTicker
+	}
+
+	// ClockTimer is a timer created by a Clock.
+	ClockTimer interface {
+		// C returns the channel receiving the time when the timer fires.
+		C() <-chan time.Time
+		// Stop prevents the timer from firing, it returns false if the
+		// timer already fired or was stopped.
+		Stop() bool
+	}
+
+	// ClockTicker is a ticker created by a Clock.
+	ClockTicker interface {
+		// C returns the channel receiving the time at each tick.
+		C() <-chan time.Time
+		// Stop turns off the ticker.
+		Stop()
+	}
+
+	// realClock is the Clock of the time package.
+	realClock struct{}
+
+	realTimer struct {
+		timer *time.Timer
+	}
+
+	realTicker struct {
+		ticker *time.Ticker
+	}
+
+	// clockKey is the key of the Clock in the context of the state machine.
+	clockKey struct{}
+)
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{timer: time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) ClockTicker {
+	return realTicker{ticker: time.NewTicker(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// clockFrom returns the Clock of the state machine owning the context.
+func clockFrom(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return clock
+	}
+	return realClock{}
+}
+
+// WithClock sets the Clock of the state machine, to control the time in
+// tests. The default is the real time.
+func WithClock(clock Clock) StmOptions {
+	return func(stm *Stm) {
+		stm.clock = clock
+	}
+}
@@ -0,0 +1,85 @@
+package stm
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// ExecStream returns a command that starts the process and sends the message
+// returned by onLine for each line it writes on its standard output, then the
+// message returned by onExit with the error of the process once it exits, or
+// with the error preventing it from starting. When cmd.Stderr is nil, the lines
+// of the standard error are sent with onLine as well: the lines of each output
+// are sent in order but the two outputs are interleaved as they are read, set
+// cmd.Stderr to keep them apart. The process is killed when the state machine
+// is terminated, and nothing more is sent. The command must not be executed
+// more than once, as an exec.Cmd can only be started once.
+func ExecStream(cmd *exec.Cmd, onLine func(string) Msg, onExit func(error) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			exit := func(err error) {
+				if ctx.Err() == nil {
+					send(onExit(err))
+				}
+			}
+
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				exit(err)
+				return
+			}
+			outputs := []io.ReadCloser{stdout}
+			if cmd.Stderr == nil {
+				stderr, err := cmd.StderrPipe()
+				if err != nil {
+					exit(err)
+					return
+				}
+				outputs = append(outputs, stderr)
+			}
+			if err := cmd.Start(); err != nil {
+				exit(err)
+				return
+			}
+
+			exited := make(chan struct{})
+			defer close(exited)
+			go func() {
+				select {
+				case <-ctx.Done():
+					// the children of the process may keep the outputs
+					// open, they are closed to stop reading them
+					_ = cmd.Process.Kill()
+					for _, output := range outputs {
+						_ = output.Close()
+					}
+				case <-exited:
+				}
+			}()
+
+			// the outputs are read until the end before waiting for the
+			// process, which closes them
+			var wg sync.WaitGroup
+			for _, output := range outputs {
+				wg.Add(1)
+				go func(output io.ReadCloser) {
+					defer wg.Done()
+					scanner := bufio.NewScanner(output)
+					for scanner.Scan() {
+						if ctx.Err() == nil {
+							send(onLine(scanner.Text()))
+						}
+					}
+					// a line too long stops the scanner, the rest is
+					// discarded so the process doesn't block on its output
+					_, _ = io.Copy(io.Discard, output)
+				}(output)
+			}
+			wg.Wait()
+			exit(cmd.Wait())
+		})
+	}
+}
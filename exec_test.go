@@ -0,0 +1,61 @@
+package stm_test
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+
+	. "github.com/fdelbos/stm"
+	"github.com/fdelbos/stm/mocks"
+	"github.com/fdelbos/stm/stmtest"
+)
+
+func (s *Suite) TestExecStream() {
+	onLine := func(line string) Msg {
+		return "line " + line
+	}
+	onExit := func(err error) Msg {
+		if err != nil {
+			return "failed"
+		}
+		return "exited"
+	}
+
+	s.Run("should send the lines then the exit", func() {
+		cmd := exec.Command("sh", "-c", "echo a; echo b")
+		s.Equal([]Msg{"line a", "line b", "exited"}, s.results(ExecStream(cmd, onLine, onExit)))
+	})
+
+	s.Run("should interleave the standard error", func() {
+		cmd := exec.Command("sh", "-c", "echo out; echo err >&2; exit 3")
+		msgs := s.results(ExecStream(cmd, onLine, onExit))
+		s.Require().Len(msgs, 3)
+		s.ElementsMatch([]Msg{"line out", "line err"}, msgs[:2])
+		s.Equal("failed", msgs[2])
+	})
+
+	s.Run("should keep the standard error apart when it is set", func() {
+		stderr := &bytes.Buffer{}
+		cmd := exec.Command("sh", "-c", "echo out; echo err >&2")
+		cmd.Stderr = stderr
+		s.Equal([]Msg{"line out", "exited"}, s.results(ExecStream(cmd, onLine, onExit)))
+		s.Equal("err\n", stderr.String())
+	})
+
+	s.Run("should report a process that can't start", func() {
+		cmd := exec.Command(s.randString())
+		s.Equal([]Msg{"failed"}, s.results(ExecStream(cmd, onLine, onExit)))
+	})
+
+	s.Run("should kill the process when the machine is terminated", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+			machine := New(ctx, mocks.NewStmState(s.T()))
+
+			cmd := exec.Command("sleep", "60")
+			machine.Send(ExecStream(cmd, onLine, onExit))
+			cancel()
+			<-machine.Done()
+		})
+	})
+}
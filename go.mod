@@ -2,7 +2,10 @@ module github.com/fdelbos/stm
 
 go 1.20
 
-require github.com/stretchr/testify v1.8.4
+require (
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/sync v0.7.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,46 @@
+package stm
+
+import "context"
+
+// KVStore is a key-value store, like etcd, redis or badger, used by KVGet and
+// KVPut. Adapt the client of the store to this interface.
+type KVStore interface {
+	// Get returns the value of the key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put sets the value of the key.
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// KVGet returns a command that reads the value of key from the store and
+// sends the message returned by onResult with the value or the error of the
+// read. The read is given the context of the state machine, nothing is sent
+// if the state machine is terminated before it completes.
+func KVGet(store KVStore, key string, onResult func([]byte, error) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			value, err := store.Get(ctx, key)
+			if ctx.Err() == nil {
+				send(onResult(value, err))
+			}
+		})
+	}
+}
+
+// KVPut returns a command that sets the value of key in the store and sends
+// onDone, or an ErrMsg if the write fails. The write is given the context of
+// the state machine, nothing is sent if the state machine is terminated
+// before it completes.
+func KVPut(store KVStore, key string, value []byte, onDone Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			err := store.Put(ctx, key, value)
+			switch {
+			case ctx.Err() != nil:
+			case err != nil:
+				send(ErrMsg{Err: err})
+			default:
+				send(onDone)
+			}
+		})
+	}
+}
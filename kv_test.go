@@ -0,0 +1,90 @@
+package stm_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	. "github.com/fdelbos/stm"
+	"github.com/fdelbos/stm/mocks"
+	"github.com/fdelbos/stm/stmtest"
+)
+
+// mapStore is a KVStore backed by a map, failing with err when it is set.
+type mapStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	err    error
+}
+
+func (m *mapStore) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.values[key], nil
+}
+
+func (m *mapStore) Put(ctx context.Context, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.values[key] = value
+	return nil
+}
+
+func (s *Suite) TestKV() {
+	onResult := func(value []byte, err error) Msg {
+		return []interface{}{string(value), err}
+	}
+
+	s.Run("should write and read a value", func() {
+		store := &mapStore{values: map[string][]byte{}}
+		key := s.randString()
+		value := s.randString()
+
+		s.Equal([]Msg{"stored"}, s.results(KVPut(store, key, []byte(value), "stored")))
+		s.Equal([]Msg{[]interface{}{value, nil}}, s.results(KVGet(store, key, onResult)))
+	})
+
+	s.Run("should report the failures", func() {
+		err := errors.New(s.randString())
+		store := &mapStore{values: map[string][]byte{}, err: err}
+
+		s.Equal([]Msg{ErrMsg{Err: err}}, s.results(KVPut(store, s.randString(), nil, "stored")))
+		s.Equal([]Msg{[]interface{}{"", err}}, s.results(KVGet(store, s.randString(), onResult)))
+	})
+
+	s.Run("should give the context of the machine to the store", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+			blocking := blockingStore{called: make(chan struct{})}
+
+			machine := New(ctx, mocks.NewStmState(s.T()))
+			machine.Send(KVGet(blocking, s.randString(), onResult))
+			<-blocking.called
+			cancel()
+			<-machine.Done()
+		})
+	})
+}
+
+// blockingStore is a KVStore blocking until the context is done.
+type blockingStore struct {
+	called chan struct{}
+}
+
+func (b blockingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	close(b.called)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b blockingStore) Put(ctx context.Context, key string, value []byte) error {
+	close(b.called)
+	<-ctx.Done()
+	return ctx.Err()
+}
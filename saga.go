@@ -0,0 +1,95 @@
+package stm
+
+import (
+	"context"
+	"fmt"
+)
+
+type (
+	// SagaStep is a step of a saga.
+	SagaStep struct {
+		// Do executes the step. The step fails if its message is an error.
+		Do Cmd
+
+		// Compensate reverts the step when a later step fails. It can be
+		// nil if the step has nothing to revert.
+		Compensate Cmd
+	}
+
+	// SagaDone is the message sent when all the steps of a saga succeeded.
+	SagaDone struct {
+		// Results holds the message of each step.
+		Results []Msg
+	}
+
+	// SagaFailed is the message sent when a step of a saga failed, once the
+	// previous steps are compensated.
+	SagaFailed struct {
+		// Step is the index of the step that failed.
+		Step int
+		// Err is the error returned by the step.
+		Err error
+		// CompensationErrs holds the errors of the compensations that
+		// failed, by step index.
+		CompensationErrs map[int]error
+	}
+)
+
+func (e SagaFailed) Error() string {
+	return fmt.Sprintf("stm: saga failed at step %d: %v", e.Step, e.Err)
+}
+
+func (e SagaFailed) Unwrap() error {
+	return e.Err
+}
+
+// Saga returns a command that executes the steps in order. If a step fails,
+// the compensations of the steps already done are executed in reverse order
+// and a SagaFailed message is sent. A failing compensation doesn't stop the
+// others, its error is reported in SagaFailed. If all the steps succeed a
+// SagaDone message is sent. A step or a compensation sending several messages
+// over time, like Retry, is done with its first message. Nothing is sent if
+// the state machine is terminated before the saga is done.
+func Saga(steps []SagaStep) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			if msg := saga(ctx, steps); ctx.Err() == nil {
+				send(msg)
+			}
+		})
+	}
+}
+
+// saga executes the steps of Saga and returns its message.
+func saga(ctx context.Context, steps []SagaStep) Msg {
+	results := make([]Msg, 0, len(steps))
+
+	for i, step := range steps {
+		if ctx.Err() != nil {
+			return nil
+		}
+		msg := await(ctx, step.Do)
+		if err, ok := msg.(error); ok {
+			return SagaFailed{
+				Step:             i,
+				Err:              err,
+				CompensationErrs: compensate(ctx, steps[:i]),
+			}
+		}
+		results = append(results, msg)
+	}
+
+	return SagaDone{Results: results}
+}
+
+// compensate executes the compensations of the given steps in reverse order
+// and returns the errors by step index.
+func compensate(ctx context.Context, steps []SagaStep) map[int]error {
+	errs := map[int]error{}
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err, ok := await(ctx, steps[i].Compensate).(error); ok {
+			errs[i] = err
+		}
+	}
+	return errs
+}
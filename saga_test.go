@@ -0,0 +1,62 @@
+package stm_test
+
+import (
+	"errors"
+
+	. "github.com/fdelbos/stm"
+)
+
+func (s *Suite) TestSaga() {
+	s.Run("should send the results when all the steps succeed", func() {
+		msg1 := s.randString()
+		msg2 := s.randString()
+
+		results := s.results(Saga([]SagaStep{
+			{Do: ToCmd(msg1)},
+			{Do: Retry(ToCmd(msg2), 1, nil, nil)},
+		}))
+		s.Equal([]Msg{SagaDone{Results: []Msg{msg1, msg2}}}, results)
+	})
+
+	s.Run("should compensate the steps in reverse order", func() {
+		err := errors.New(s.randString())
+		errCompensate := errors.New(s.randString())
+		compensated := []int{}
+
+		results := s.results(Saga([]SagaStep{
+			{
+				Do: ToCmd(s.randString()),
+				Compensate: func() Msg {
+					compensated = append(compensated, 0)
+					return nil
+				},
+			},
+			{
+				Do: ToCmd(s.randString()),
+				Compensate: func() Msg {
+					compensated = append(compensated, 1)
+					return ErrMsg{Err: errCompensate}
+				},
+			},
+			{
+				Do: ToCmd(ErrMsg{Err: err}),
+				Compensate: func() Msg {
+					compensated = append(compensated, 2)
+					return nil
+				},
+			},
+			{
+				Do: ToCmd(s.randString()),
+			},
+		}))
+
+		s.Require().Len(results, 1)
+		failed, ok := results[0].(SagaFailed)
+		s.Require().True(ok)
+		s.Equal(2, failed.Step)
+		s.ErrorIs(failed, err)
+		s.Len(failed.CompensationErrs, 1)
+		s.ErrorIs(failed.CompensationErrs[1], errCompensate)
+		s.Equal([]int{1, 0}, compensated)
+	})
+}
@@ -2,7 +2,21 @@ package stm
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type (
@@ -15,12 +29,17 @@ type (
 	// are then sent synchronously (1 by 1) to the state machine as soon as they are ready.
 	Cmd func() Msg
 
+	// CmdCtx is a command that receives a context, it is done when the
+	// command is cancelled or when the state machine is terminated.
+	CmdCtx func(context.Context) Msg
+
 	// State is an interface that can be used to implement a state of a state machine.
 	State interface {
 		// Update is called when a message is received by the state machine.
 		// It returns the next state and a command to execute. Make sure that
 		// the command is not blocking. If you need to block, return a command instead,
 		// the resulting message will be sent to the state machine when the command is executed.
+		// Returning a nil state keeps the current state, the command is still executed.
 		Update(Msg) (State, Cmd)
 
 		// Init is called when the state machine is created. You can use this method
@@ -28,30 +47,641 @@ type (
 		Init() Cmd
 	}
 
+	// TimedState is a state that sends a message to itself when it doesn't
+	// receive any message for some time.
+	TimedState interface {
+		State
+
+		// Timeout returns the duration of inactivity after which the
+		// returned message is given to the state. It is called when the
+		// state is entered and after every message processed by the state.
+		Timeout() (time.Duration, Msg)
+	}
+
+	// ExitState is a state that is notified when the state machine leaves
+	// it.
+	ExitState interface {
+		State
+
+		// OnExit is called when Update returns a different state. The
+		// returned command is executed first and the command returned by
+		// Update, which holds the Init command of the new state when using
+		// TransitionTo, only once the message of OnExit is processed, as
+		// with Sequence. States are compared with ==, or with
+		// reflect.DeepEqual for the types that are not comparable.
+		OnExit() Cmd
+	}
+
+	// SenderInitState is a state that receives the state machine when it is
+	// initialized, so it can send several commands.
+	SenderInitState interface {
+		State
+
+		// InitWithSender is called instead of Init by TransitionTo. The
+		// commands sent with the sender are dispatched before the returned
+		// command, and run concurrently as with Send. It is called in the
+		// goroutine of a command, not from the loop.
+		InitWithSender(Sender) Cmd
+	}
+
+	// ShutdownState is a state that is notified when the state machine is
+	// terminated while it is the current state.
+	ShutdownState interface {
+		State
+
+		// OnShutdown is called from the loop right before it exits, after
+		// the shutdown command if any. Commands can't be sent anymore at
+		// this point, so it should release the resources of the state
+		// directly.
+		OnShutdown()
+	}
+
+	// Deadlined is a message carrying its own deadline, like a request with
+	// a timeout.
+	Deadlined interface {
+		// Deadline returns the deadline of the commands returned by Update
+		// for the message. They are given a context derived from the one of
+		// the state machine, done at the deadline or when the state machine
+		// is terminated, whichever comes first. At the deadline the
+		// commands receiving the context, like ContextCmd or Timer, behave
+		// as if the state machine was terminated: they stop and nothing
+		// more is sent. The commands of a Batch or a Sequence are scoped
+		// as well, the plain commands that don't receive the context are
+		// not interrupted.
+		Deadline() time.Time
+	}
+
+	// LogEntry describes a message processed by the state machine.
+	LogEntry struct {
+		// Msg is the message given to Update.
+		Msg Msg
+		// From is the state that received the message.
+		From State
+		// To is the state after the message.
+		To State
+		// HasCmd is true when Update returned a command.
+		HasCmd bool
+		// Changed is true when To is a different state than From.
+		Changed bool
+		// Diff describes the change between From and To, it is only set
+		// when Changed is true and WithStateDiff is used.
+		Diff string
+	}
+
+	// Logger receives every message processed by the state machine.
+	Logger interface {
+		// Log is called from the loop right after Update returns, blocking
+		// in Log stalls the state machine.
+		Log(LogEntry)
+	}
+
+	// Transition is a state change recorded in the history of the state
+	// machine, see WithHistory.
+	Transition struct {
+		// From is the state that received the message.
+		From State
+		// To is the new state.
+		To State
+		// At is when the transition happened.
+		At time.Time
+		// Trigger is the message that caused the transition.
+		Trigger Msg
+		// Diff describes the change between From and To, see
+		// WithStateDiff.
+		Diff string
+	}
+
+	// historyEntry is a transition exported by ExportHistory.
+	historyEntry struct {
+		From    string          `json:"from"`
+		To      string          `json:"to"`
+		At      time.Time       `json:"at"`
+		Trigger string          `json:"trigger"`
+		Msg     json.RawMessage `json:"msg,omitempty"`
+		Diff    string          `json:"diff,omitempty"`
+	}
+
+	// Metrics receives counts and timings of the state machine, for
+	// monitoring. Its methods are called concurrently and must not block.
+	Metrics interface {
+		// MessageProcessed is called from the loop with each message given
+		// to Update.
+		MessageProcessed(Msg)
+		// CommandStarted is called when a command sent to the state
+		// machine starts.
+		CommandStarted()
+		// CommandFinished is called with the duration of the command once
+		// it returns, or once it is done for a command sending messages
+		// over time like ContextCmd.
+		CommandFinished(d time.Duration)
+		// Transition is called from the loop when Update returns a
+		// different state.
+		Transition(from, to State)
+	}
+
+	// LoggerFunc is a function implementing Logger.
+	LoggerFunc func(LogEntry)
+
 	batched []Cmd
 
+	// stream is the message produced by commands sending several messages
+	// over time. It is executed with the context of the state machine and a
+	// function delivering messages to the state machine.
+	stream func(ctx context.Context, send func(Msg))
+
+	// sequence is the message produced by Sequence.
+	sequence []Cmd
+
+	// transition is the message produced by the command of TransitionTo.
+	// When the command is returned by Update, the loop resolves it after
+	// the rewriter had the chance to replace the state, otherwise the Init
+	// command of the state is built when it is dispatched. wrap, when not
+	// nil, is applied to the Init command.
+	transition struct {
+		state State
+		wrap  func(Cmd) Cmd
+		cmds  []Cmd
+	}
+
+	// sequenceStep is a message produced by a command of a sequence, the
+	// rest of the sequence is executed once the message is processed.
+	sequenceStep struct {
+		msg  Msg
+		rest sequence
+	}
+
+	// CmdPanic is the message sent when a command panics and panic recovery
+	// is enabled with WithPanicRecovery.
+	CmdPanic struct {
+		// Err holds the value of the panic.
+		Err error
+		// Stack is the stack trace of the goroutine that panicked.
+		Stack []byte
+	}
+
+	// ErrMsg is a message carrying an error.
+	ErrMsg struct {
+		Err error
+	}
+
+	// Collected is the message sent by Collect once all its commands are
+	// done.
+	Collected struct {
+		// Results holds the message of each command, in the order the
+		// commands were given. The result of a command returning nil is nil.
+		Results []Msg
+	}
+
+	// EmitBatch is the message received by the parent of a state machine
+	// created with WithEmitBatch, it holds the messages of Emit in the order
+	// they were emitted.
+	EmitBatch []Msg
+
+	// ChainLimitExceeded is the message sent instead of executing the
+	// command returned by Update when the chain of messages is longer than
+	// the limit set with WithMaxChainDepth.
+	ChainLimitExceeded struct {
+		// Depth is the limit that was exceeded.
+		Depth int
+	}
+
+	// UndispatchedError is the error reported on the Errors channel when
+	// commands of a Batch are not dispatched, it wraps ErrUndispatched.
+	UndispatchedError struct {
+		// Indices holds the index in the batch of each command that was
+		// not dispatched.
+		Indices []int
+		// Size is the number of commands of the batch.
+		Size int
+	}
+
+	// BarrierHandle is the handle of the command of a Barrier, used to
+	// report the completed items. It is safe for concurrent use.
+	BarrierHandle struct {
+		done  chan struct{}
+		count int64
+	}
+
+	// chained is a message produced by a command returned by Update when
+	// the chain depth is tracked, it is unwrapped by the loop.
+	chained struct {
+		msg   Msg
+		depth int
+	}
+
+	// ReconnectScheduled is the message sent by Reconnect when an attempt
+	// fails, before waiting for the next one.
+	ReconnectScheduled struct {
+		// Attempt is the number of the failed attempt.
+		Attempt int
+		// Err is the error of the failed attempt.
+		Err error
+		// Delay is the time before the next attempt.
+		Delay time.Duration
+	}
+
+	// Buffered is the message sent by BufferBy when a buffer is flushed.
+	Buffered struct {
+		// Key is the key of the buffer.
+		Key string
+		// Items holds the items in the order they were buffered.
+		Items []Msg
+	}
+
+	// itemBuffer is a pending buffer of BufferBy, cancel stops its timer.
+	itemBuffer struct {
+		items  []Msg
+		cancel context.CancelFunc
+	}
+
+	// relay is the parent of a state machine set with Merge.
+	relay struct {
+		to Sender
+	}
+
+	// namedCmd is a command started with SendNamed.
+	namedCmd struct {
+		cancel context.CancelFunc
+	}
+
+	// yielded is the message produced by Yield, it is handled by the loop
+	// and never reaches Update.
+	yielded struct {
+		msg Msg
+	}
+
+	// syncMsg is a message sent with SendSync, done is closed once it is
+	// processed.
+	syncMsg struct {
+		msg  Msg
+		done chan struct{}
+	}
+
+	// debounce is the message produced by Debounce, it is handled by the
+	// loop and never reaches Update.
+	debounce struct {
+		key string
+		d   time.Duration
+		msg Msg
+	}
+
+	// throttle is the message produced by Throttle, it is handled by the
+	// loop and msg is given to Update unless the key is cooling down.
+	throttle struct {
+		key      string
+		cooldown time.Duration
+		msg      Msg
+	}
+
+	// BreakerOpen is the message sent by CircuitBreaker instead of executing
+	// its command while the breaker is open.
+	BreakerOpen struct {
+		// Name is the name of the breaker.
+		Name string
+	}
+
+	// breaker is the message produced by CircuitBreaker, it is handled by
+	// the loop which executes cmd unless the breaker is open.
+	breaker struct {
+		name      string
+		cmd       Cmd
+		threshold int
+		cooldown  time.Duration
+		isFailure func(Msg) bool
+	}
+
+	// breakerResult is the message of a command executed by a breaker.
+	breakerResult struct {
+		breaker
+		msg Msg
+	}
+
+	// breakerState is the state of a breaker, failures are the consecutive
+	// failures and trial is set while a half-open breaker executes its
+	// command.
+	breakerState struct {
+		failures  int
+		openUntil time.Time
+		trial     bool
+	}
+
+	// pushed is the state returned by Push, the loop saves the current
+	// state on the stack and transitions to State.
+	pushed struct {
+		State
+	}
+
+	// popped is the state returned by Pop, the loop transitions to the
+	// state on top of the stack.
+	popped struct{}
+
+	// quit is the message produced by Quit.
+	quit struct{}
+
+	// idleWaiter is the message produced by OnceIdle and WaitIdle, it is
+	// handled by the loop and never reaches Update. When the machine is idle
+	// msg is sent, or done is closed if set.
+	idleWaiter struct {
+		msg  Msg
+		done chan struct{}
+	}
+
+	// senderKey is the key of the state machine in its context.
+	senderKey struct{}
+
 	// Sender is an interface that can send commands to a state machine.
 	// Use this interface to send commands to the state machine from outside.
 	Sender interface {
 		Send(Cmd)
 	}
 
+	// StateCondition is a condition on the state of a state machine, see
+	// WaitForAny.
+	StateCondition struct {
+		Machine *Stm
+		// Match reports whether the state satisfies the condition, it is
+		// called from the goroutine of the command.
+		Match func(State) bool
+	}
+
+	// NamedSender is a recipient of BroadcastCollect, its name identifies
+	// the outcome of the delivery.
+	NamedSender struct {
+		Name string
+		To   *Stm
+	}
+
 	// Stm is a state machine.
 	Stm struct {
 		messages chan Msg
-		state    State
+		// priority holds the messages sent with SendPriority, they are
+		// processed before the ones in messages.
+		priority chan Msg
+		// pause receives the requests of Pause and Resume.
+		pause chan bool
+		// configure receives the changes of the hooks read by the loop, they
+		// are applied from the loop.
+		configure chan func()
+		// errs receives the internal failures, see Errors.
+		errs chan error
+
+		// state is only written by the loop, holding stateMu. stateChanged,
+		// when not nil, is closed when the state changes, to wake up the
+		// commands of WaitForAny.
+		stateMu      sync.RWMutex
+		state        State
+		stateChanged chan struct{}
+		// stack holds the states saved by Push, it is only accessed from the
+		// loop.
+		stack []State
+
+		ctx    context.Context
+		cancel context.CancelCauseFunc
+		// stopped is closed when the loop exits.
+		stopped chan struct{}
+
+		// draining receives the context of Shutdown, closing is set first
+		// so the commands sent from outside of the state machine are
+		// ignored.
+		draining     chan context.Context
+		closing      int32
+		shutdownOnce sync.Once
+
+		// number of commands currently running in their own goroutine.
+		pending int64
+		// lastActivity is when the loop last started or finished processing
+		// a message in Unix nanoseconds, busy is set while it processes one
+		// and paused while it is paused.
+		lastActivity int64
+		busy         int32
+		paused       int32
+		// wake notifies the loop that all pending commands are done.
+		wake        chan struct{}
+		idleWaiters []idleWaiter
+
+		shutdownCmd     Cmd
+		shutdownTimeout time.Duration
+
+		maxLifetime time.Duration
+		batchSize   int
+
+		watchdogTimeout time.Duration
+		onStuck         func()
+
+		updateTimeout time.Duration
+		onSlow        func(Msg, time.Duration)
+
+		// chainDepth is the depth of the message being processed, it is
+		// only accessed from the loop.
+		maxChainDepth int
+		chainDepth    int
+
+		initialCmds    []Cmd
+		logger         Logger
+		rewriter       func(from, to State, cause Msg) State
+		middlewares    []func(Msg) (Msg, bool)
+		cmdMiddlewares []func(Cmd) Cmd
+		onTransition   func(from, to State)
+		stateDiff      func(prev, next State) string
+		metrics        Metrics
+		clock          Clock
+		recoverPanics  bool
+		synchronous    bool
+		bufferPolicy   FullBufferPolicy
+
+		// dedupSeen holds when the messages were delivered by key, it is
+		// only accessed from the loop and swept every dedupWindow.
+		dedupWindow time.Duration
+		dedupKey    func(Msg) string
+		dedupSeen   map[string]time.Time
+		dedupSwept  time.Time
 
-		ctx context.Context
+		// history is a ring buffer of the last transitions, next is the
+		// index of the next entry once it is full.
+		historyMu   sync.Mutex
+		history     []Transition
+		historySize int
+		historyNext int
+
+		checkpointEvery int
+		onCheckpoint    func(State) Msg
+		transitions     int
+
+		// workers receives the commands for the idle worker goroutines when
+		// pooling is enabled.
+		workers chan Cmd
+
+		// when maxConcurrent > 0, at most maxConcurrent commands run at the
+		// same time and the others wait in queue.
+		maxConcurrent int
+		queueMu       sync.Mutex
+		queue         []Cmd
+		active        int
+
+		// with the deterministic scheduler, the commands wait in queue and
+		// the scheduler executes them one at a time, picking the next one
+		// with random.
+		random        *rand.Rand
+		wakeScheduler chan struct{}
+
+		// timer of the current state when it is a TimedState.
+		timeout    ClockTimer
+		timeoutMsg Msg
+
+		// subscribers receive a copy of the messages given to Update, it is
+		// set to nil when the state machine is terminated.
+		subscribersMu sync.Mutex
+		subscribers   map[chan Msg]struct{}
+
+		namedMu sync.Mutex
+		named   map[string]*namedCmd
+		// debounced holds the pending messages of Debounce.
+		debounced map[string]*namedCmd
+		// timers holds the pending timers of KeyedTimer.
+		timers map[string]*namedCmd
+		// throttled holds the end of the cooldown of the keys of Throttle,
+		// it is only accessed from the loop.
+		throttled map[string]time.Time
+		// throttledSweep is the end of the earliest cooldown of throttled,
+		// when the expired keys are deleted.
+		throttledSweep time.Time
+		// breakers holds the state of the breakers of CircuitBreaker, it is
+		// only accessed from the loop.
+		breakers map[string]*breakerState
+
+		// relay receives the messages of Emit, see Merge.
+		relayMu sync.Mutex
+		relay   *relay
+
+		// emitted holds the messages of Emit waiting to be flushed with
+		// WithEmitBatch, emitFlushes counts the flushes so that a timer
+		// started for a batch already flushed does nothing.
+		emitBatch   bool
+		emitSize    int
+		emitFlush   time.Duration
+		emitMu      sync.Mutex
+		emitted     []Msg
+		emitFlushes int
+
+		// buffers holds the pending buffers of BufferBy by key.
+		buffersMu sync.Mutex
+		buffers   map[string]*itemBuffer
+
+		// onceKeys holds the keys of the commands of Once already executed.
+		onceMu   sync.Mutex
+		onceKeys map[string]struct{}
 	}
 
 	// Option is a function that can be used to configure a state machine.
 	StmOptions func(*Stm)
+
+	// FullBufferPolicy is what happens to the message of a command when the
+	// message buffer is full, see WithFullBufferPolicy.
+	FullBufferPolicy int
+)
+
+const (
+	// BlockPolicy waits until there is room in the buffer, it is the
+	// default.
+	BlockPolicy FullBufferPolicy = iota
+
+	// DropNewest discards the incoming message.
+	DropNewest
+
+	// DropOldest discards the oldest buffered message to make room for the
+	// incoming one.
+	DropOldest
 )
 
 // default size of the message buffer.
 const DefaultMessageBufferSize = 10
 
+// DefaultPriorityBufferSize is the default size of the buffer of the messages
+// sent with SendPriority.
+const DefaultPriorityBufferSize = 10
+
+// WorkerIdleTimeout is the time after which an idle worker goroutine exits
+// when pooling is enabled with WithPooling.
+const WorkerIdleTimeout = time.Second
+
+// PumpInterval is the interval at which Pump checks the capacity again once it
+// is exhausted.
+const PumpInterval = time.Millisecond * 10
+
+// MemoryPressureInterval is the interval at which OnMemoryPressure samples the
+// memory statistics.
+const MemoryPressureInterval = time.Second
+
+// ErrLifetimeExceeded is the reason of the termination of a state machine
+// that reached the duration set with WithMaxLifetime.
+var ErrLifetimeExceeded = errors.New("stm: max lifetime exceeded")
+
+// ErrQuit is the reason of the termination of a state machine stopped by the
+// Quit command.
+var ErrQuit = errors.New("stm: quit")
+
+// ErrTerminated is returned when a state machine is terminated before
+// completing an operation.
+var ErrTerminated = errors.New("stm: state machine terminated")
+
+// ErrRunning is returned by Restart when the state machine or its commands
+// are still running.
+var ErrRunning = errors.New("stm: state machine running")
+
+// ErrShutdown is the reason of the termination of a state machine stopped
+// with Shutdown.
+var ErrShutdown = errors.New("stm: shut down")
+
+// ErrDropped is reported on the Errors channel when a message is dropped
+// because the buffer is full, or because the state machine is terminated
+// while the message waits for room in the buffer.
+var ErrDropped = errors.New("stm: message dropped")
+
+// ErrUndispatched is reported on the Errors channel, wrapped in an
+// UndispatchedError, when commands of a Batch are not dispatched because the
+// state machine is terminated while the batch is expanded.
+var ErrUndispatched = errors.New("stm: batch commands not dispatched")
+
+// ErrTooManyConflicts is the error sent by OnConflict when the operation is
+// still conflicting after all the retries.
+var ErrTooManyConflicts = errors.New("stm: too many conflicts")
+
+// ErrNoQuorum is the error sent by Quorum when the commands didn't agree.
+var ErrNoQuorum = errors.New("stm: no quorum")
+
+// ErrUnexpectedMsg is the error sent by Expect when a command produces a
+// message of the wrong type.
+var ErrUnexpectedMsg = errors.New("stm: unexpected message type")
+
+func (e ErrMsg) Error() string {
+	return e.Err.Error()
+}
+
+func (e ErrMsg) Unwrap() error {
+	return e.Err
+}
+
+func (e UndispatchedError) Error() string {
+	return fmt.Sprintf("%v: %d of %d, at %v", ErrUndispatched, len(e.Indices), e.Size, e.Indices)
+}
+
+func (e UndispatchedError) Unwrap() error {
+	return ErrUndispatched
+}
+
+// None returns a command that does nothing, to make explicit that Update
+// has no command to execute. It is nil, so it is ignored by Send without
+// starting a goroutine, unlike ToCmd(nil) which executes a command producing
+// no message.
+func None() Cmd {
+	return nil
+}
+
 // Batch returns a command that will execute the given list of commands.
+// The commands are executed concurrently and their messages are delivered
+// without ordering guarantee. A Batch nested in a batch, at any depth, is
+// expanded the same way: each command is executed once and each message is
+// delivered once. Use Flatten for an ordered delivery.
 func Batch(cmds ...Cmd) Cmd {
 	return func() Msg {
 		b := batched{}
@@ -62,6 +692,82 @@ func Batch(cmds ...Cmd) Cmd {
 	}
 }
 
+// Sequence returns a command that executes the given commands one after the
+// other: a command is only executed once the message of the previous one has
+// been processed by the state machine. Commands returning nil are skipped.
+// The sequence stops when the state machine is terminated. A Batch or a
+// Sequence nested in a sequence is dispatched without waiting for its
+// messages.
+func Sequence(cmds ...Cmd) Cmd {
+	return func() Msg {
+		return sequence(cmds)
+	}
+}
+
+// Flatten returns a command that executes the given commands one after the
+// other in its own goroutine, expanding the nested Batch commands depth
+// first, then delivers their messages in that order, each message once the
+// previous one is processed. Commands returning nil are skipped. Unlike
+// Batch, the commands don't run concurrently, so it suits commands that
+// don't block.
+func Flatten(cmds ...Cmd) Cmd {
+	return func() Msg {
+		flat := sequence{}
+
+		var expand func(cmds []Cmd)
+		expand = func(cmds []Cmd) {
+			for _, cmd := range cmds {
+				if cmd == nil {
+					continue
+				}
+				switch msg := cmd().(type) {
+				case nil:
+				case batched:
+					expand(msg)
+				default:
+					flat = append(flat, ToCmd(msg))
+				}
+			}
+		}
+		expand(cmds)
+
+		return flat
+	}
+}
+
+// OrderedBatch returns a command that executes the given commands
+// concurrently, as Batch, but delivers their messages in the order of the
+// commands once they are all done, each message once the previous one is
+// processed. Commands returning nil are skipped. Unlike Sequence, the
+// commands don't wait for the messages of the previous ones to be processed
+// to be executed. A command sending several messages over time, like Retry,
+// is done with its first message. Nothing is sent if the state machine is
+// terminated before all the commands are done.
+func OrderedBatch(cmds ...Cmd) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ordered := sequence{}
+			for _, msg := range runAll(ctx, cmds) {
+				if msg != nil {
+					ordered = append(ordered, ToCmd(msg))
+				}
+			}
+			if ctx.Err() == nil {
+				send(ordered)
+			}
+		})
+	}
+}
+
+// Quit returns a command that terminates the state machine when its message is
+// processed, as if its context was cancelled. The reason returned by Err is
+// ErrQuit.
+func Quit() Cmd {
+	return func() Msg {
+		return quit{}
+	}
+}
+
 // ToCmd returns a command that will send the given message immediatly.
 func ToCmd(msg Msg) Cmd {
 	return func() Msg {
@@ -69,89 +775,3901 @@ func ToCmd(msg Msg) Cmd {
 	}
 }
 
+// ErrorCmd returns a command that sends an ErrMsg carrying err immediately.
+func ErrorCmd(err error) Cmd {
+	return ToCmd(ErrMsg{Err: err})
+}
+
+// Perform returns a command that executes fn and sends its message, or an
+// ErrMsg carrying its error if it fails.
+func Perform(fn func() (Msg, error)) Cmd {
+	return func() Msg {
+		msg, err := fn()
+		if err != nil {
+			return ErrMsg{Err: err}
+		}
+		return msg
+	}
+}
+
 // TransitionTo returns a `Cmd` and a `State` to transition to the given state,
 // initializing it, calling the Init method of the given state and
-// executing the given commands after the transition.
+// executing the given commands after the transition. When the command is
+// returned by Update, Init is called from the loop right after Update, before
+// the next message is processed, and it is not called if the state is
+// replaced by the function set with WithTransitionRewriter.
 func TransitionTo(state State, cmds ...Cmd) (State, Cmd) {
-	init := state.Init()
-	cmds = append([]Cmd{init}, cmds...)
-	return state, Batch(cmds...)
+	return state, transitionCmd(transition{state: state, cmds: cmds})
 }
 
-// Timer returns a command that will send the given message after the given
-// duration.
-func Timer(t time.Duration, timeExceedMessage Msg) Cmd {
+// transitionCmd returns a command producing t. The commands it returns share
+// the code of the same function literal, which is how transitionOf
+// recognizes them, so it must not be inlined.
+//
+//go:noinline
+func transitionCmd(t transition) Cmd {
 	return func() Msg {
-		if t < 0 {
-			t = 0
+		return t
+	}
+}
+
+// transitionPC is the code pointer of the commands returned by
+// transitionCmd.
+var transitionPC = reflect.ValueOf(transitionCmd(transition{})).Pointer()
+
+// transitionOf returns the transition produced by cmd when it is a command
+// of transitionCmd, without executing any other command.
+func transitionOf(cmd Cmd) (transition, bool) {
+	if cmd == nil || reflect.ValueOf(cmd).Pointer() != transitionPC {
+		return transition{}, false
+	}
+	t, ok := cmd().(transition)
+	return t, ok
+}
+
+// expand returns the commands of the transition, its Init command first.
+func (t transition) expand() batched {
+	return append(batched{initCmd(t.state, t.wrap)}, t.cmds...)
+}
+
+// initCmd returns the command initializing the state, from Init or from
+// InitWithSender if the state is a SenderInitState. When wrap is not nil, it
+// is applied to the non-nil command returned by Init or InitWithSender.
+func initCmd(state State, wrap func(Cmd) Cmd) Cmd {
+	if wrap == nil {
+		wrap = func(cmd Cmd) Cmd { return cmd }
+	}
+	s, ok := state.(SenderInitState)
+	if !ok {
+		if init := state.Init(); init != nil {
+			return wrap(init)
 		}
-		timer := time.NewTimer(t)
-		<-timer.C
-		return timeExceedMessage
+		return nil
+	}
+	return func() Msg {
+		return stream(func(ctx context.Context, _ func(Msg)) {
+			sender := ctx.Value(senderKey{}).(Sender)
+			if init := s.InitWithSender(sender); init != nil {
+				sender.Send(wrap(init))
+			}
+		})
 	}
 }
 
-func (stm *Stm) loop() {
-	for {
-		select {
+// TransitionIf works like TransitionTo with yes when cond is true and with no
+// otherwise. Only the Init method of the chosen state is called.
+func TransitionIf(cond bool, yes State, no State, cmds ...Cmd) (State, Cmd) {
+	if cond {
+		return TransitionTo(yes, cmds...)
+	}
+	return TransitionTo(no, cmds...)
+}
 
-		case <-stm.ctx.Done():
-			return
+// Push works like TransitionTo but the current state is saved on a stack, so
+// that Pop returns to it. It is meant for temporary states, like a
+// confirmation dialog.
+func Push(state State, cmds ...Cmd) (State, Cmd) {
+	next, cmd := TransitionTo(state, cmds...)
+	return pushed{State: next}, cmd
+}
 
-		case msg := <-stm.messages:
-			var cmd Cmd
-			stm.state, cmd = stm.state.Update(msg)
-			if cmd != nil {
-				stm.Send(cmd)
+// Pop returns to the state saved by the last Push, without calling its Init
+// method. If the stack is empty, the current state is kept.
+func Pop() (State, Cmd) {
+	return popped{}, nil
+}
+
+func (popped) Init() Cmd {
+	return nil
+}
+
+func (p popped) Update(Msg) (State, Cmd) {
+	return p, nil
+}
+
+// Tick returns a command that sends the given message every d, starting after
+// d, until the state machine is terminated.
+func Tick(d time.Duration, msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ticker := clockFrom(ctx).NewTicker(d)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					send(msg)
+				}
 			}
-		}
+		})
 	}
 }
 
-// Send a command to the state machine. Note that the execution of the command
-// is done in a goroutine and therefore the order of execution is not guaranteed.
-func (stm *Stm) Send(cmd Cmd) {
-	if cmd == nil {
-		return
+// Every returns a command that sends the given message immediately, then
+// every d until the state machine is terminated. Unlike Tick, it doesn't wait
+// d before the first message.
+func Every(d time.Duration, msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			send(msg)
+
+			ticker := clockFrom(ctx).NewTicker(d)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					send(msg)
+				}
+			}
+		})
 	}
-	go func() {
-		msg := cmd()
-		if msg == nil {
-			return
-		}
+}
 
-		if batch, ok := msg.(batched); ok {
-			// recursively send all commands in the batch
-			for _, batchCmd := range batch {
-				stm.Send(batchCmd)
+// FromTicker returns a command that sends the message returned by f for each
+// tick of t until the state machine is terminated. The ticker stays owned by
+// the caller: it is not stopped on termination and must be stopped by the
+// caller once it is no longer needed. Once it is stopped no more messages are
+// sent, but the command only ends with the state machine. Unlike Tick, it
+// doesn't follow the Clock of the state machine.
+func FromTicker(t *time.Ticker, f func(time.Time) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-t.C:
+					send(f(now))
+				}
 			}
+		})
+	}
+}
 
-		} else {
-			stm.messages <- msg
-		}
-	}()
+// Heartbeat returns a command that calls beat every interval, starting after
+// interval, and sends onLost then stops once a beat fails, like when the
+// lease of a leader is lost. It follows the Clock of the state machine and
+// stops without sending anything when the state machine is terminated.
+func Heartbeat(interval time.Duration, beat func() error, onLost Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ticker := clockFrom(ctx).NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					if err := beat(); err != nil && ctx.Err() == nil {
+						send(onLost)
+						return
+					}
+				}
+			}
+		})
+	}
 }
 
-// New creates and starts a state machine with the initial state and options.
-// The state machine will be terminated when the context is done.
-func New(ctx context.Context, initialState State, opts ...StmOptions) *Stm {
-	stm := &Stm{
-		messages: make(chan Msg, DefaultMessageBufferSize),
-		state:    initialState,
-		ctx:      ctx,
+// OnMemoryPressure returns a command that samples the heap every
+// MemoryPressureInterval, following the Clock of the state machine, and
+// sends msg each time the allocated heap exceeds threshold bytes after being
+// under it, so it is sent once per crossing. It stops when the state machine
+// is terminated. Each sample calls runtime.ReadMemStats, which briefly stops
+// the world, so the interval should stay in the order of seconds.
+func OnMemoryPressure(threshold uint64, msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ticker := clockFrom(ctx).NewTicker(MemoryPressureInterval)
+			defer ticker.Stop()
+
+			var stats runtime.MemStats
+			above := false
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					runtime.ReadMemStats(&stats)
+					if stats.HeapAlloc > threshold {
+						if !above {
+							send(msg)
+						}
+						above = true
+					} else {
+						above = false
+					}
+				}
+			}
+		})
 	}
+}
 
-	for _, opt := range opts {
-		opt(stm)
+// TransitionToWithTimeout works like TransitionTo but if the Init command of
+// the given state doesn't produce its message within d, onTimeout is sent
+// instead and the late message of Init is discarded. The command returned by
+// InitWithSender is timed the same way for a SenderInitState. States without
+// an Init command transition as with TransitionTo.
+func TransitionToWithTimeout(state State, d time.Duration, onTimeout Msg, cmds ...Cmd) (State, Cmd) {
+	wrap := func(init Cmd) Cmd {
+		return withTimeout(init, d, onTimeout)
 	}
+	return state, transitionCmd(transition{state: state, wrap: wrap, cmds: cmds})
+}
 
-	go stm.loop()
-	return stm
+// withTimeout returns a command that sends onTimeout if cmd doesn't return,
+// or for a command sending messages over time doesn't send its first one,
+// within d. The command is then canceled and its messages are discarded.
+func withTimeout(cmd Cmd, d time.Duration, onTimeout Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			// started is set to 1 when cmd sends its first message or
+			// returns, and to 2 when the timeout fires first.
+			var started int32
+			forward := func(msg Msg) {
+				if atomic.CompareAndSwapInt32(&started, 0, 1) || atomic.LoadInt32(&started) == 1 {
+					send(msg)
+				}
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				msg := cmd()
+				if s, ok := msg.(stream); ok {
+					s(ctx, forward)
+					atomic.CompareAndSwapInt32(&started, 0, 1)
+					return
+				}
+				forward(msg)
+			}()
+
+			timer := clockFrom(ctx).NewTimer(d)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				if atomic.CompareAndSwapInt32(&started, 0, 2) {
+					send(onTimeout)
+					return
+				}
+			case <-done:
+			case <-ctx.Done():
+				atomic.StoreInt32(&started, 2)
+				return
+			}
+			<-done
+		})
+	}
 }
 
-// WithMessageBufferSize sets the size of the message buffer
-func WithMessageBufferSize(size int) StmOptions {
-	return func(stm *Stm) {
-		stm.messages = make(chan Msg, size)
+// Timer returns a command that will send the given message after the given
+// duration, following the Clock of the state machine. Nothing is sent if the
+// state machine is terminated first.
+func Timer(t time.Duration, timeExceedMessage Msg) Cmd {
+	if t < 0 {
+		t = 0
+	}
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			timer := clockFrom(ctx).NewTimer(t)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				send(timeExceedMessage)
+			case <-ctx.Done():
+			}
+		})
+	}
+}
+
+// TimerAt returns a command that will send the given message at the given
+// deadline, or immediately if it is already past. Nothing is sent if the
+// state machine is terminated first. It can be raced against other commands
+// with Select, the timer is then stopped once a message is selected.
+func TimerAt(deadline time.Time, msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			clock := clockFrom(ctx)
+			d := deadline.Sub(clock.Now())
+			if d < 0 {
+				d = 0
+			}
+			timer := clock.NewTimer(d)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				send(msg)
+			case <-ctx.Done():
+			}
+		})
+	}
+}
+
+// CancelableTimer returns a command that will send the given message after the
+// given duration, and a function to cancel it. Once cancelled, or when the
+// state machine is terminated, the command returns without sending the
+// message. The command can be executed several times, cancel stops all of
+// them and the following ones.
+func CancelableTimer(d time.Duration, msg Msg) (Cmd, context.CancelFunc) {
+	if d < 0 {
+		d = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := func() Msg {
+		return stream(func(stmCtx context.Context, send func(Msg)) {
+			timer := clockFrom(stmCtx).NewTimer(d)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				if ctx.Err() == nil {
+					send(msg)
+				}
+			case <-ctx.Done():
+			case <-stmCtx.Done():
+			}
+		})
+	}
+	return cmd, cancel
+}
+
+// ContextCmd adapts a command receiving the context of the state machine so
+// it can be returned from Update. The context is done when the state machine
+// is terminated, the message of a command returning after the termination is
+// discarded. The message is delivered as is, a Batch or a Sequence returned
+// by cmd is not dispatched.
+func ContextCmd(cmd CmdCtx) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			msg := cmd(ctx)
+			if ctx.Err() == nil {
+				send(msg)
+			}
+		})
+	}
+}
+
+// FromChannel returns a command that waits for a value on the given channel
+// and sends the message returned by wrap. Nothing is sent if the channel is
+// closed or the state machine is terminated first. Return the command again
+// from Update to keep receiving the values of the channel in order.
+func FromChannel[T any](ch <-chan T, wrap func(T) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			select {
+			case value, ok := <-ch:
+				if ok {
+					send(wrap(value))
+				}
+			case <-ctx.Done():
+			}
+		})
+	}
+}
+
+// AwaitErr returns a command that waits for the error of an operation
+// signaling its completion on ch, and sends the message returned by onDone
+// with it. If the channel is closed without a value, onDone is called with
+// nil, as for an operation that succeeded. Nothing is sent if the state
+// machine is terminated first.
+func AwaitErr(ch <-chan error, onDone func(error) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			select {
+			case err := <-ch:
+				send(onDone(err))
+			case <-ctx.Done():
+			}
+		})
+	}
+}
+
+// AwaitCond returns a command that waits on c until pred returns true, then
+// sends msg. pred is called with c.L locked, first before waiting and then
+// each time c is signaled. Nothing is sent if the state machine is terminated
+// first: as a sync.Cond can't be selected on, the termination locks c.L and
+// broadcasts c to wake the command up, so it is delayed while c.L is held
+// and the other goroutines waiting on c are woken up as well.
+func AwaitCond(c *sync.Cond, pred func() bool, msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				select {
+				case <-ctx.Done():
+					c.L.Lock()
+					c.Broadcast()
+					c.L.Unlock()
+				case <-stop:
+				}
+			}()
+
+			c.L.Lock()
+			for ctx.Err() == nil && !pred() {
+				c.Wait()
+			}
+			done := ctx.Err() == nil
+			c.L.Unlock()
+
+			if done {
+				send(msg)
+			}
+		})
+	}
+}
+
+// UntilDone returns a command that waits for ctx to be done, whatever the
+// reason, and sends the message returned by msg with the error of ctx.
+// Nothing is sent if the state machine is terminated first, even when ctx is
+// derived from the context of the state machine.
+func UntilDone(ctx context.Context, msg func(error) Msg) Cmd {
+	return func() Msg {
+		return stream(func(stmCtx context.Context, send func(Msg)) {
+			select {
+			case <-ctx.Done():
+				send(msg(ctx.Err()))
+			case <-stmCtx.Done():
+			}
+		})
+	}
+}
+
+// Barrier returns a command that waits for n items to be completed, and the
+// handle to report them with Done. For each completed item the message
+// returned by itemMsg with the number of completed items and n is sent, then
+// finalMsg once all of them are completed. itemMsg can be nil to only send
+// finalMsg. The calls to Done beyond n are ignored and don't block, even
+// once the state machine is terminated, in which case nothing is sent.
+func Barrier(n int, itemMsg func(done, total int) Msg, finalMsg Msg) (Cmd, *BarrierHandle) {
+	if n < 0 {
+		n = 0
+	}
+	handle := &BarrierHandle{done: make(chan struct{}, n)}
+	cmd := func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			for done := 1; done <= n; done++ {
+				select {
+				case <-handle.done:
+				case <-ctx.Done():
+					return
+				}
+				if itemMsg != nil {
+					send(itemMsg(done, n))
+				}
+			}
+			send(finalMsg)
+		})
+	}
+	return cmd, handle
+}
+
+// Done reports that an item of the barrier is completed.
+func (b *BarrierHandle) Done() {
+	if atomic.AddInt64(&b.count, 1) <= int64(cap(b.done)) {
+		b.done <- struct{}{}
+	}
+}
+
+// WatchContext returns a command that sends the message returned by onDone
+// with the error of an external context, like the context of a request
+// served by the state machine, once it is done. It works as UntilDone:
+// nothing is sent if the state machine is terminated first.
+func WatchContext(ctx context.Context, onDone func(error) Msg) Cmd {
+	return UntilDone(ctx, onDone)
+}
+
+// DrainChannel returns a command that reads all the values immediately
+// available in the given channel, without blocking, and sends the message
+// returned by wrap. If the channel is empty wrap is called with an empty
+// slice, return nil from wrap to send nothing in that case.
+func DrainChannel[T any](ch <-chan T, wrap func([]T) Msg) Cmd {
+	return func() Msg {
+		values := []T{}
+		for {
+			select {
+			case v, ok := <-ch:
+				if !ok {
+					return wrap(values)
+				}
+				values = append(values, v)
+			default:
+				return wrap(values)
+			}
+		}
+	}
+}
+
+// Forward returns a command that sends the given message to another state
+// machine, like a child machine created with NewChild or the parent of a
+// child. The command doesn't produce any message for the state machine that
+// sends it.
+func Forward(to Sender, msg Msg) Cmd {
+	return func() Msg {
+		to.Send(ToCmd(msg))
+		return nil
+	}
+}
+
+// Merge routes the messages of Emit sent by the children to parent, so that
+// several state machines can report to the same one. Merging a child again
+// replaces its parent. The contexts are not tied, create the children with
+// NewChild to terminate them with the parent. Merge returns a function that
+// stops the relay, after which Emit discards the messages of the children.
+func Merge(parent Sender, children ...*Stm) (stop func()) {
+	r := &relay{to: parent}
+	for _, child := range children {
+		child.relayMu.Lock()
+		child.relay = r
+		child.relayMu.Unlock()
+	}
+
+	return func() {
+		for _, child := range children {
+			child.relayMu.Lock()
+			if child.relay == r {
+				child.relay = nil
+			}
+			child.relayMu.Unlock()
+		}
+	}
+}
+
+// Emit returns a command that sends the given message to the parent the state
+// machine is merged into with Merge. The message is discarded if the state
+// machine is not merged. The command doesn't produce any message for the state
+// machine that sends it. See WithEmitBatch to send the messages in batches.
+func Emit(msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, _ func(Msg)) {
+			stm := ctx.Value(senderKey{}).(*Stm)
+			r := stm.parent()
+			if r == nil {
+				return
+			}
+			if stm.emitBatch {
+				stm.batchEmit(msg)
+				return
+			}
+			r.to.Send(ToCmd(msg))
+		})
+	}
+}
+
+// parent returns the relay set with Merge, or nil.
+func (stm *Stm) parent() *relay {
+	stm.relayMu.Lock()
+	defer stm.relayMu.Unlock()
+	return stm.relay
+}
+
+// batchEmit adds the message to the batch, flushing it when it is full. The
+// first message of a batch starts the timer flushing it.
+func (stm *Stm) batchEmit(msg Msg) {
+	stm.emitMu.Lock()
+	defer stm.emitMu.Unlock()
+
+	stm.emitted = append(stm.emitted, msg)
+	if stm.emitSize > 0 && len(stm.emitted) >= stm.emitSize {
+		stm.flushEmitted()
+		return
+	}
+	if len(stm.emitted) > 1 || stm.emitFlush <= 0 {
+		return
+	}
+
+	flushes := stm.emitFlushes
+	timer := stm.clock.NewTimer(stm.emitFlush)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			stm.emitMu.Lock()
+			defer stm.emitMu.Unlock()
+			if stm.emitFlushes == flushes {
+				stm.flushEmitted()
+			}
+		case <-stm.ctx.Done():
+		}
+	}()
+}
+
+// flushEmitted sends the batch to the parent, if any. It must be called with
+// emitMu held.
+func (stm *Stm) flushEmitted() {
+	if len(stm.emitted) == 0 {
+		return
+	}
+	batch := EmitBatch(stm.emitted)
+	stm.emitted = nil
+	stm.emitFlushes++
+	if r := stm.parent(); r != nil {
+		r.to.Send(ToCmd(batch))
+	}
+}
+
+// Broadcast returns a command that executes the given command once and sends
+// the resulting message to every sender. All the recipients share the same
+// message value, so it should be treated as immutable. The command itself
+// doesn't produce any message for the state machine that sends it, add it to
+// the senders to receive it as well. For a command sending messages over time,
+// like ContextCmd, its first message is broadcast.
+func Broadcast(senders []Sender, cmd Cmd) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, _ func(Msg)) {
+			msg := await(ctx, cmd)
+			if msg == nil {
+				return
+			}
+			for _, sender := range senders {
+				sender.Send(ToCmd(msg))
+			}
+		})
+	}
+}
+
+// BroadcastCollect works like Broadcast, but the message is delivered to each
+// recipient with TrySend and the message returned by done is sent with the
+// outcome of each delivery by name: nil when the message is accepted in the
+// buffer of the recipient, ErrTerminated when the recipient is terminated and
+// ErrDropped when its buffer is full. Nothing is sent if cmd produces no
+// message or the state machine is terminated before the outcomes are known.
+func BroadcastCollect(recipients []NamedSender, cmd Cmd, done func(map[string]error) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			msg := await(ctx, cmd)
+			if msg == nil {
+				return
+			}
+
+			accepted := make([]<-chan bool, len(recipients))
+			for i, recipient := range recipients {
+				accepted[i] = recipient.To.TrySend(ToCmd(msg))
+			}
+
+			outcomes := make(map[string]error, len(recipients))
+			for i, recipient := range recipients {
+				select {
+				case ok := <-accepted[i]:
+					switch {
+					case ok:
+						outcomes[recipient.Name] = nil
+					case recipient.To.Err() != nil:
+						outcomes[recipient.Name] = ErrTerminated
+					default:
+						outcomes[recipient.Name] = ErrDropped
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+			send(done(outcomes))
+		})
+	}
+}
+
+// WaitForAny returns a command that waits until the state of the machine of
+// one of the conditions matches it, and sends the message returned by result
+// with the index of that condition. When several conditions are already
+// satisfied, any of them may be reported. The other conditions stop being
+// watched once one is satisfied. Nothing is sent if the state machine is
+// terminated first, or if all the watched machines are terminated without
+// satisfying their condition.
+func WaitForAny(conds []StateCondition, result func(index int) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			var wg sync.WaitGroup
+			defer wg.Wait()
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			satisfied := make(chan int, len(conds))
+			for i, cond := range conds {
+				wg.Add(1)
+				go func(i int, cond StateCondition) {
+					defer wg.Done()
+					if cond.Machine.waitState(ctx, cond.Match) {
+						satisfied <- i
+					} else {
+						satisfied <- -1
+					}
+				}(i, cond)
+			}
+
+			for range conds {
+				select {
+				case i := <-satisfied:
+					if i >= 0 {
+						send(result(i))
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+}
+
+// waitState blocks until the state of the state machine matches, it returns
+// false if ctx is done or the state machine is terminated first.
+func (stm *Stm) waitState(ctx context.Context, match func(State) bool) bool {
+	for {
+		stm.stateMu.Lock()
+		state := stm.state
+		if stm.stateChanged == nil {
+			stm.stateChanged = make(chan struct{})
+		}
+		changed := stm.stateChanged
+		stm.stateMu.Unlock()
+
+		if match(state) {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		case <-stm.Done():
+			return false
+		}
+	}
+}
+
+// SingleFlight returns a command that executes fn through the given group, so
+// concurrent commands with the same key are collapsed into a single execution
+// and all receive its result. If fn fails, an ErrMsg with the error is sent.
+func SingleFlight(group *singleflight.Group, key string, fn func() (Msg, error)) Cmd {
+	return func() Msg {
+		msg, err, _ := group.Do(key, func() (interface{}, error) {
+			return fn()
+		})
+		if err != nil {
+			return ErrMsg{Err: err}
+		}
+		return msg
+	}
+}
+
+// Expect returns a command that checks that the message produced by the given
+// command is of type T. If it is not, an ErrMsg wrapping ErrUnexpectedMsg is
+// sent instead. A nil message is not checked. Each message of a Batch, a
+// Sequence or a command sending over time is checked, see Map.
+func Expect[T Msg](cmd Cmd) Cmd {
+	return Map(cmd, func(msg Msg) Msg {
+		if _, ok := msg.(T); !ok {
+			return ErrMsg{
+				Err: fmt.Errorf("%w: got %T, expected %s",
+					ErrUnexpectedMsg, msg, reflect.TypeOf((*T)(nil)).Elem()),
+			}
+		}
+		return msg
+	})
+}
+
+// Sample returns a command that executes the given command every time it is
+// called but only sends every nth message it produces, the other messages are
+// dropped. Nil messages are not counted. The returned command keeps the
+// count, reuse it to sample a source of messages. Each message of a Batch, a
+// Sequence or a command sending over time is counted, see Map. If n <= 1
+// every message is sent.
+func Sample(n int, cmd Cmd) Cmd {
+	if n <= 1 {
+		return cmd
+	}
+	count := int64(0)
+	return Map(cmd, func(msg Msg) Msg {
+		if atomic.AddInt64(&count, 1)%int64(n) != 0 {
+			return nil
+		}
+		return msg
+	})
+}
+
+// Timed returns a command that measures the execution time of the given
+// command and sends the message returned by wrap with its result and
+// duration, measured with the Clock of the state machine. A nil result is not
+// wrapped. Each message of a Batch, a Sequence or a command sending over time
+// is wrapped, see Map, with the time elapsed since the command started.
+func Timed(cmd Cmd, wrap func(Msg, time.Duration) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			clock := clockFrom(ctx)
+			start := clock.Now()
+			send(Map(cmd, func(msg Msg) Msg {
+				return wrap(msg, clock.Now().Sub(start))
+			})())
+		})
+	}
+}
+
+// OnConflict returns a command that executes op and retries it, up to
+// maxRetries times, as long as it fails with an error for which isConflict
+// returns true. Other errors are sent immediately as an ErrMsg. If op still
+// conflicts after the last retry, an ErrMsg wrapping both ErrTooManyConflicts
+// and the last error is sent. op is given a context canceled when the state
+// machine is terminated, in which case it is not retried and nothing is sent.
+func OnConflict(op func(context.Context) (Msg, error), isConflict func(error) bool, maxRetries int) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			for retry := 0; ; retry++ {
+				msg, err := op(ctx)
+				switch {
+				case ctx.Err() != nil:
+					return
+				case err == nil:
+					send(msg)
+					return
+				case !isConflict(err):
+					send(ErrMsg{Err: err})
+					return
+				case retry >= maxRetries:
+					send(ErrMsg{Err: fmt.Errorf("%w: %w", ErrTooManyConflicts, err)})
+					return
+				}
+			}
+		})
+	}
+}
+
+// WithCounter returns a command that calls inc when the given command produces
+// its message, right before it is dispatched. inc is not called if the
+// command produces nil. inc is called for each message of a Batch, a Sequence
+// or a command sending over time, see Map.
+func WithCounter(cmd Cmd, inc func()) Cmd {
+	return Map(cmd, func(msg Msg) Msg {
+		inc()
+		return msg
+	})
+}
+
+// FromEnv returns a command that reads the given environment variables and
+// sends the message returned by build. Variables that are not set are absent
+// from the map given to build. If build fails, an ErrMsg is sent instead.
+func FromEnv(keys []string, build func(map[string]string) (Msg, error)) Cmd {
+	return func() Msg {
+		env := make(map[string]string, len(keys))
+		for _, key := range keys {
+			if value, ok := os.LookupEnv(key); ok {
+				env[key] = value
+			}
+		}
+
+		msg, err := build(env)
+		if err != nil {
+			return ErrMsg{Err: err}
+		}
+		return msg
+	}
+}
+
+// Quorum returns a command that executes the given commands concurrently and
+// sends the first message for which threshold commands produced an equal
+// message, according to equal. Nil messages are not counted. If all the
+// commands are done without reaching the threshold, an ErrMsg wrapping
+// ErrNoQuorum is sent. The commands still running when the quorum is reached
+// are not interrupted, their messages are discarded. The commands sending
+// several messages over time, like Retry, vote with their first message and
+// are cancelled once the quorum is reached. Nothing is sent if the state
+// machine is terminated first.
+func Quorum(threshold int, equal func(a, b Msg) bool, cmds ...Cmd) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			if msg := quorum(ctx, threshold, equal, cmds); ctx.Err() == nil {
+				send(msg)
+			}
+		})
+	}
+}
+
+// quorum executes the commands of Quorum and returns its message.
+func quorum(ctx context.Context, threshold int, equal func(a, b Msg) bool, cmds []Cmd) Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan Msg, len(cmds))
+	for _, cmd := range cmds {
+		go func(cmd Cmd) {
+			results <- await(ctx, cmd)
+		}(cmd)
+	}
+
+	type vote struct {
+		msg   Msg
+		count int
+	}
+	votes := []*vote{}
+
+	for range cmds {
+		var msg Msg
+		select {
+		case msg = <-results:
+		case <-ctx.Done():
+			return nil
+		}
+		if msg == nil {
+			continue
+		}
+
+		var current *vote
+		for _, v := range votes {
+			if equal(v.msg, msg) {
+				current = v
+				break
+			}
+		}
+		if current == nil {
+			current = &vote{msg: msg}
+			votes = append(votes, current)
+		}
+
+		current.count++
+		if current.count >= threshold {
+			return current.msg
+		}
+	}
+	return ErrMsg{Err: ErrNoQuorum}
+}
+
+// Debounce returns a command that sends the given message after d, unless
+// another Debounce command with the same key is issued in the meantime. Each
+// command with the same key cancels the pending message of the previous one
+// and restarts the delay, so only the last message is sent once the key has
+// been quiet for d. Keys are scoped to the state machine and the pending
+// messages are discarded when it is terminated.
+func Debounce(key string, d time.Duration, msg Msg) Cmd {
+	return func() Msg {
+		return debounce{key: key, d: d, msg: msg}
+	}
+}
+
+// KeyedTimer returns a command that sends the given message after d, unless
+// the timer is cancelled with CancelTimer and the same key first. Scheduling a
+// timer with the key of a pending one replaces it, which resets the delay.
+// Keys are scoped to the state machine and the pending timers are discarded
+// when it is terminated.
+func KeyedTimer(key string, d time.Duration, msg Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, _ func(Msg)) {
+			stm := ctx.Value(senderKey{}).(*Stm)
+			stm.sendNamed(stm.timers, key, func(ctx context.Context) Msg {
+				timer := clockFrom(ctx).NewTimer(d)
+				defer timer.Stop()
+
+				select {
+				case <-timer.C():
+					return msg
+				case <-ctx.Done():
+					return nil
+				}
+			})
+		})
+	}
+}
+
+// CancelTimer returns a command that cancels the timer of KeyedTimer with the
+// given key, if it is pending when the command is executed.
+func CancelTimer(key string) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, _ func(Msg)) {
+			stm := ctx.Value(senderKey{}).(*Stm)
+			stm.cancelNamed(stm.timers, key)
+		})
+	}
+}
+
+// BufferBy returns a command that adds item to the buffer of the given key,
+// and sends a Buffered message with the items of the buffer once it holds
+// maxItems items or maxWait after its first item, whichever comes first. The
+// first item added after a flush starts a new buffer. With maxItems <= 0, the
+// buffer is only flushed after maxWait. Keys are scoped to the state machine
+// and the pending items are dropped when it is terminated.
+func BufferBy(key string, maxItems int, maxWait time.Duration, item Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			stm := ctx.Value(senderKey{}).(*Stm)
+			if items := stm.bufferItem(key, maxItems, maxWait, item); items != nil {
+				send(Buffered{Key: key, Items: items})
+			}
+		})
+	}
+}
+
+// bufferItem adds the item to the buffer of the key, starting its timer if
+// it is new, and returns the items if the buffer is full.
+func (stm *Stm) bufferItem(key string, maxItems int, maxWait time.Duration, item Msg) []Msg {
+	stm.buffersMu.Lock()
+	buf, ok := stm.buffers[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(stm.ctx)
+		buf = &itemBuffer{cancel: cancel}
+		stm.buffers[key] = buf
+
+		// sent once unlocked, as it may run inline
+		defer stm.send(func() Msg {
+			return stream(func(_ context.Context, send func(Msg)) {
+				timer := clockFrom(ctx).NewTimer(maxWait)
+				defer timer.Stop()
+
+				select {
+				case <-timer.C():
+					if flushed := stm.flushBuffer(key, buf); flushed != nil {
+						send(flushed)
+					}
+				case <-ctx.Done():
+				}
+			})
+		})
+	}
+	defer stm.buffersMu.Unlock()
+
+	buf.items = append(buf.items, item)
+	if maxItems <= 0 || len(buf.items) < maxItems {
+		return nil
+	}
+	delete(stm.buffers, key)
+	buf.cancel()
+	return buf.items
+}
+
+// flushBuffer returns the Buffered message of the buffer once its timer
+// fires, unless it was already flushed because it was full.
+func (stm *Stm) flushBuffer(key string, buf *itemBuffer) Msg {
+	stm.buffersMu.Lock()
+	defer stm.buffersMu.Unlock()
+
+	buf.cancel()
+	if stm.buffers[key] != buf {
+		return nil
+	}
+	delete(stm.buffers, key)
+	return Buffered{Key: key, Items: buf.items}
+}
+
+// Reconnect returns a command that calls connect with the context of the state
+// machine until it succeeds, and sends its message. The first attempt has the
+// given number. When an attempt fails, a ReconnectScheduled message is sent
+// and the next attempt is made after the delay returned by backoff with the
+// number of the failed attempt. It stops without sending anything once the
+// state machine is terminated. The delays follow the Clock of the state
+// machine.
+func Reconnect(attempt int, connect func(context.Context) (Msg, error), backoff func(int) time.Duration) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			for ; ctx.Err() == nil; attempt++ {
+				msg, err := connect(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				if err == nil {
+					send(msg)
+					return
+				}
+
+				delay := backoff(attempt)
+				send(ReconnectScheduled{Attempt: attempt, Err: err, Delay: delay})
+
+				timer := clockFrom(ctx).NewTimer(delay)
+				select {
+				case <-timer.C():
+				case <-ctx.Done():
+				}
+				timer.Stop()
+			}
+		})
+	}
+}
+
+// Retry returns a command that executes cmd until shouldRetry returns false
+// for its message or attempts executions have been made, and sends the last
+// message. Before each new attempt it waits for the delay returned by backoff
+// with the number of the failed attempt, starting at 1. If the state machine
+// is terminated while waiting, nothing is sent. cmd is always executed at
+// least once, even if attempts <= 0. The message is delivered as is, a Batch
+// or a Sequence returned by cmd is not dispatched. A command sending messages
+// over time, like Timer, is done with its first message.
+func Retry(cmd Cmd, attempts int, backoff func(attempt int) time.Duration, shouldRetry func(Msg) bool) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			for attempt := 1; ; attempt++ {
+				msg := await(ctx, cmd)
+				if attempt >= attempts || !shouldRetry(msg) {
+					send(msg)
+					return
+				}
+
+				timer := clockFrom(ctx).NewTimer(backoff(attempt))
+				select {
+				case <-timer.C():
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		})
+	}
+}
+
+// Once returns a command that executes cmd only the first time a command of
+// Once with the same key is executed by the state machine, nothing is sent
+// the following times. Keys are scoped to the state machine and are reset by
+// Restart. The key is taken when cmd is dispatched, so a second command with
+// the same key is ignored even if the first one is still running.
+func Once(key string, cmd Cmd) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() Msg {
+		return stream(func(ctx context.Context, _ func(Msg)) {
+			stm := ctx.Value(senderKey{}).(*Stm)
+			if stm.once(key) {
+				stm.send(cmd)
+			}
+		})
+	}
+}
+
+// once reports whether the key of Once is seen for the first time.
+func (stm *Stm) once(key string) bool {
+	stm.onceMu.Lock()
+	defer stm.onceMu.Unlock()
+
+	if _, ok := stm.onceKeys[key]; ok {
+		return false
+	}
+	stm.onceKeys[key] = struct{}{}
+	return true
+}
+
+// Throttle returns a command that sends the given message, unless a message
+// was sent by a Throttle command with the same key less than cooldown ago,
+// in which case nothing is sent. Only the first message of each cooldown
+// window is sent. Keys are scoped to the state machine and the cooldown
+// starts when the message is processed.
+func Throttle(key string, cooldown time.Duration, msg Msg) Cmd {
+	return func() Msg {
+		return throttle{key: key, cooldown: cooldown, msg: msg}
+	}
+}
+
+// CircuitBreaker returns a command that executes cmd unless the breaker with
+// the given name is open, in which case BreakerOpen is sent instead. The
+// breaker opens after threshold consecutive messages of cmd for which
+// isFailure returns true, and stays open for cooldown. Then it is half-open:
+// cmd is executed once, BreakerOpen being sent for the other commands of the
+// breaker meanwhile, and a success closes the breaker while a failure opens
+// it again. For a command sending messages over time, like ContextCmd, its
+// first message is classified and sent. The breakers are scoped to the state
+// machine and use its Clock. If threshold <= 0, a single failure opens the
+// breaker.
+func CircuitBreaker(name string, cmd Cmd, threshold int, cooldown time.Duration, isFailure func(Msg) bool) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return func() Msg {
+		return breaker{
+			name:      name,
+			cmd:       cmd,
+			threshold: threshold,
+			cooldown:  cooldown,
+			isFailure: isFailure,
+		}
+	}
+}
+
+// Collect returns a command that executes the given commands concurrently and
+// sends a single Collected message holding all their messages once they are
+// all done. Nil messages are kept in the results so each result matches the
+// command at the same index. The messages are not dispatched, a command
+// returning a Batch appears as is in the results, while the result of a
+// command sending several messages over time, like Retry, is its first
+// message. If the state machine is terminated before all the commands are
+// done, nothing is sent.
+func Collect(cmds ...Cmd) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			done := make(chan []Msg, 1)
+			go func() {
+				done <- runAll(ctx, cmds)
+			}()
+
+			select {
+			case <-ctx.Done():
+			case results := <-done:
+				send(Collected{Results: results})
+			}
+		})
+	}
+}
+
+// runAll executes the commands concurrently and returns their messages in
+// the order of the commands once they are all done, see await.
+func runAll(ctx context.Context, cmds []Cmd) []Msg {
+	results := make([]Msg, len(cmds))
+
+	var wg sync.WaitGroup
+	wg.Add(len(cmds))
+	for i, cmd := range cmds {
+		go func(i int, cmd Cmd) {
+			defer wg.Done()
+			results[i] = await(ctx, cmd)
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Select returns a command that executes the given commands concurrently and
+// sends the first non-nil message, for example to race a command against a
+// Timer. The commands still running are not interrupted, their messages are
+// discarded. The commands sending several messages over time, like TimerAt or
+// Retry, take part with their first message and are cancelled once a message
+// is selected. If all the commands return nil or the state machine is
+// terminated first, nothing is sent.
+func Select(cmds ...Cmd) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			results := make(chan Msg, len(cmds))
+			for _, cmd := range cmds {
+				go func(cmd Cmd) {
+					results <- await(ctx, cmd)
+				}(cmd)
+			}
+
+			for range cmds {
+				select {
+				case msg := <-results:
+					if msg != nil {
+						send(msg)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+}
+
+// Yield returns a command that sends the given message after all the messages
+// already in the buffer when the command's result reaches the loop. A normal
+// command only queues its message behind the messages buffered when it
+// completes; Yield re-enqueues the message from the loop itself, giving all
+// the pending messages a chance to be processed first.
+func Yield(msg Msg) Cmd {
+	return func() Msg {
+		return yielded{msg: msg}
+	}
+}
+
+// Pump returns a command that pulls items and sends them as long as
+// capacityOK returns true, until pull reports that no item remains. When the
+// capacity is exhausted it waits for the state machine to catch up, checking
+// the capacity again every PumpInterval, following the Clock of the state
+// machine. If capacityOK is nil, the capacity is available while the message
+// buffer is not full, see QueueLen. Delivering an item also waits while the
+// buffer is full. The command stops when the state machine is terminated.
+func Pump(pull func() (Msg, bool), capacityOK func() bool) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			hasCapacity := capacityOK
+			if hasCapacity == nil {
+				stm := ctx.Value(senderKey{}).(*Stm)
+				hasCapacity = func() bool {
+					return stm.QueueLen() < stm.QueueCap()
+				}
+			}
+
+			for ctx.Err() == nil {
+				if !hasCapacity() {
+					timer := clockFrom(ctx).NewTimer(PumpInterval)
+					select {
+					case <-timer.C():
+					case <-ctx.Done():
+						timer.Stop()
+						return
+					}
+					continue
+				}
+
+				item, ok := pull()
+				if !ok {
+					return
+				}
+				send(item)
+			}
+		})
+	}
+}
+
+// Group returns a command that executes the given functions with at most
+// maxConcurrency of them running at the same time, and sends the message of
+// each one as soon as it succeeds. The functions are given a context derived
+// from the one of the state machine, canceled on the first error: an ErrMsg
+// is then sent once the running functions have returned and the functions not
+// started yet are skipped. The messages of the functions that succeed, even
+// after the error, are still sent. If the state machine is terminated, the
+// error is not sent. If maxConcurrency <= 0 the concurrency is not limited.
+func Group(maxConcurrency int, fns ...func(context.Context) (Msg, error)) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			group, groupCtx := errgroup.WithContext(ctx)
+			if maxConcurrency > 0 {
+				group.SetLimit(maxConcurrency)
+			}
+
+			for _, fn := range fns {
+				fn := fn
+				group.Go(func() error {
+					if groupCtx.Err() != nil {
+						return nil
+					}
+					msg, err := fn(groupCtx)
+					if err != nil {
+						return err
+					}
+					send(msg)
+					return nil
+				})
+			}
+
+			if err := group.Wait(); err != nil && ctx.Err() == nil {
+				send(ErrMsg{Err: err})
+			}
+		})
+	}
+}
+
+// Pipeline returns a command that executes cmd and passes its message through
+// each stage in order before sending it. If the command or a stage returns
+// nil, the following stages are skipped and nothing is sent. Each message of
+// a Batch, a Sequence or a command sending over time goes through the stages,
+// see Map.
+func Pipeline(cmd Cmd, stages ...func(Msg) Msg) Cmd {
+	return Map(cmd, func(msg Msg) Msg {
+		for _, stage := range stages {
+			if msg == nil {
+				return nil
+			}
+			msg = stage(msg)
+		}
+		return msg
+	})
+}
+
+// When returns a command that evaluates pred when it is executed, and
+// executes cmd only if pred returns true. Nothing is sent otherwise. pred
+// runs in the goroutine of the command, concurrently with the loop and the
+// other commands, so the state it reads must be safe for concurrent access.
+func When(pred func() bool, cmd Cmd) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() Msg {
+		if !pred() {
+			return nil
+		}
+		return cmd()
+	}
+}
+
+// Then returns a command that executes first, builds a command with next
+// from its message and executes it in the same goroutine. Only the message of
+// the second command is sent, the message of first is discarded. If first
+// returns nil, next is not called and nothing is sent. next is called with
+// each message of a Batch, a Sequence or a command sending over time, see
+// Map.
+func Then(first Cmd, next func(Msg) Cmd) Cmd {
+	return Map(first, func(msg Msg) Msg {
+		cmd := next(msg)
+		if cmd == nil {
+			return nil
+		}
+		return cmd()
+	})
+}
+
+// Chain returns a command that executes the steps in order, each one building
+// its command from the message of the previous step. The first step receives
+// nil. Only the message of the last step is sent, and the chain stops without
+// sending anything when a step returns a nil command or message. If the chain
+// doesn't complete within d, following the Clock of the state machine, the
+// remaining steps are cancelled and onTimeout is sent instead. The context of
+// the running step is then canceled and its message is discarded. A duration
+// of 0 or less disables the timeout. Nothing is sent once the state machine
+// is terminated.
+func Chain(d time.Duration, onTimeout Msg, steps ...func(Msg) Cmd) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			var deadline <-chan time.Time
+			if d > 0 {
+				timer := clockFrom(ctx).NewTimer(d)
+				defer timer.Stop()
+				deadline = timer.C()
+			}
+
+			var msg Msg
+			for _, step := range steps {
+				cmd := step(msg)
+				if cmd == nil {
+					return
+				}
+
+				result := make(chan Msg, 1)
+				go func() {
+					result <- await(ctx, cmd)
+				}()
+
+				select {
+				case msg = <-result:
+					if msg == nil {
+						return
+					}
+				case <-deadline:
+					send(onTimeout)
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+			send(msg)
+		})
+	}
+}
+
+// Scan returns a command that executes the steps one after the other and
+// folds their messages into an accumulator starting at init. The accumulator
+// returned by reduce is sent after each step, so the state machine receives
+// the running value. Steps returning nil are skipped and the remaining steps
+// are not executed once the state machine is terminated. The messages are
+// delivered as is, a Batch or a Sequence returned by a step is given to
+// reduce, while a step sending several messages over time, like Retry, is
+// done with its first message.
+func Scan(steps []Cmd, init Msg, reduce func(acc, msg Msg) Msg) Cmd {
+	return func() Msg {
+		return stream(func(ctx context.Context, send func(Msg)) {
+			acc := init
+			for _, step := range steps {
+				if ctx.Err() != nil {
+					return
+				}
+				if msg := await(ctx, step); msg != nil {
+					acc = reduce(acc, msg)
+					send(acc)
+				}
+			}
+		})
+	}
+}
+
+// Map returns a command that executes cmd and sends its message transformed
+// by fn. If cmd returns nil, fn is not called and nothing is sent. When cmd
+// returns a Batch or a Sequence, fn is applied to the message of each of its
+// commands, and when it sends several messages over time, like Retry or Tick,
+// fn is applied to each of them. The messages of the other commands of this
+// package that are not delivered to Update as is, like Yield or Throttle,
+// are not transformed.
+func Map(cmd Cmd, fn func(Msg) Msg) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() Msg {
+		return mapMsg(cmd(), fn)
+	}
+}
+
+// mapMsg applies fn to the message of a command, see Map.
+func mapMsg(msg Msg, fn func(Msg) Msg) Msg {
+	switch m := msg.(type) {
+	case nil:
+		return nil
+
+	case batched:
+		mapped := make(batched, len(m))
+		for i, c := range m {
+			mapped[i] = Map(c, fn)
+		}
+		return mapped
+
+	case sequence:
+		mapped := make(sequence, len(m))
+		for i, c := range m {
+			mapped[i] = Map(c, fn)
+		}
+		return mapped
+
+	case stream:
+		return stream(func(ctx context.Context, send func(Msg)) {
+			m(ctx, func(msg Msg) {
+				send(mapMsg(msg, fn))
+			})
+		})
+
+	case transition:
+		return mapMsg(m.expand(), fn)
+	}
+
+	if isInternal(msg) {
+		return msg
+	}
+	return fn(msg)
+}
+
+// withDeadline returns a command executing cmd with the context of the state
+// machine bounded by deadline, for the messages implementing Deadlined. The
+// commands of a Batch or a Sequence returned by cmd get the deadline too.
+func withDeadline(cmd Cmd, deadline time.Time) Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() Msg {
+		switch m := cmd().(type) {
+		case batched:
+			scoped := make(batched, len(m))
+			for i, c := range m {
+				scoped[i] = withDeadline(c, deadline)
+			}
+			return scoped
+
+		case sequence:
+			scoped := make(sequence, len(m))
+			for i, c := range m {
+				scoped[i] = withDeadline(c, deadline)
+			}
+			return scoped
+
+		case transition:
+			return withDeadline(ToCmd(m.expand()), deadline)()
+
+		case stream:
+			return stream(func(ctx context.Context, send func(Msg)) {
+				ctx, cancel := context.WithDeadline(ctx, deadline)
+				defer cancel()
+				m(ctx, func(msg Msg) {
+					if ctx.Err() == nil {
+						send(msg)
+					}
+				})
+			})
+
+		default:
+			return m
+		}
+	}
+}
+
+// isInternal reports whether msg is one of the messages of the commands of
+// this package that are not delivered to Update as is, like the messages of
+// Batch, Tick or Yield.
+func isInternal(msg Msg) bool {
+	switch msg.(type) {
+	case sequenceStep, idleWaiter, yielded, quit, throttle, breaker,
+		breakerResult, debounce, syncMsg, chained:
+		return true
+	}
+	return isExpanded(msg)
+}
+
+// isExpanded reports whether msg is expanded by the state machine into other
+// commands before reaching the loop, like the messages of Batch, Sequence or
+// Tick. The other internal messages are handled by the loop.
+func isExpanded(msg Msg) bool {
+	switch msg.(type) {
+	case batched, sequence, stream, transition:
+		return true
+	}
+	return false
+}
+
+// await executes cmd and returns its message. When cmd sends several
+// messages over time, like Retry or TimerAt, it runs with ctx until its first
+// message, which is returned, then it is cancelled. nil is returned if it
+// ends or ctx is done before sending anything.
+func await(ctx context.Context, cmd Cmd) Msg {
+	if cmd == nil {
+		return nil
+	}
+	msg := cmd()
+	s, ok := msg.(stream)
+	if !ok {
+		return msg
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	first := make(chan Msg, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s(ctx, func(msg Msg) {
+			if msg == nil {
+				return
+			}
+			select {
+			case first <- msg:
+			default:
+			}
+		})
+	}()
+
+	select {
+	case msg := <-first:
+		return msg
+	case <-done:
+	case <-ctx.Done():
+		return nil
+	}
+	select {
+	case msg := <-first:
+		return msg
+	default:
+		return nil
+	}
+}
+
+// Match calls fn if msg is a T and returns its result with true, otherwise it
+// returns false without calling fn. It lets Update chain the handling of
+// several message types:
+//
+//	if next, cmd, ok := Match(msg, s.onStart); ok {
+//		return next, cmd
+//	}
+func Match[T any](msg Msg, fn func(T) (State, Cmd)) (State, Cmd, bool) {
+	m, ok := msg.(T)
+	if !ok {
+		return nil, nil, false
+	}
+	next, cmd := fn(m)
+	return next, cmd, true
+}
+
+// StateName returns a readable name for the given state, to use when logging
+// transitions. It is the result of String when the state implements
+// fmt.Stringer, the name of its concrete type otherwise.
+func StateName(s State) string {
+	if s == nil {
+		return "<nil>"
+	}
+	if stringer, ok := s.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return reflect.TypeOf(s).String()
+}
+
+// Reply returns a command that executes cmd and sends its message to the
+// state machine as well as to ch, so code outside of the machine can wait
+// for it. The message is put on ch when the command returns, before it is
+// processed by the state machine, and it is dropped from ch if the channel
+// is not ready to receive it, so ch should be buffered. Nothing is sent when
+// cmd returns nil. Each message of a Batch, a Sequence or a command sending
+// over time is sent to ch, see Map.
+func Reply(cmd Cmd, ch chan<- Msg) Cmd {
+	return Map(cmd, func(msg Msg) Msg {
+		select {
+		case ch <- msg:
+		default:
+		}
+		return msg
+	})
+}
+
+// OnceIdle returns a command that will send the given message the first time
+// the state machine is idle after the command is issued. The machine is idle
+// when no command is running, the message buffer is empty and the loop is not
+// processing a message. The message is sent at most once.
+func OnceIdle(msg Msg) Cmd {
+	return func() Msg {
+		return idleWaiter{msg: msg}
+	}
+}
+
+func (stm *Stm) loop() {
+	defer close(stm.stopped)
+
+	stm.armTimeout()
+	defer stm.stopTimeout()
+
+	stm.runInitialCommands()
+
+	draining := stm.draining
+	paused := false
+	for stm.ctx.Err() == nil {
+		// while paused, nothing is given to Update
+		messages, priority, timeout, drain := stm.messages, stm.priority, stm.timeoutC(), draining
+		if paused {
+			messages, priority, timeout, drain = nil, nil, nil, nil
+		}
+
+		select {
+		case msg := <-priority:
+			stm.process(msg)
+			stm.processBuffered(stm.batchSize - 1)
+			stm.notifyIdle()
+			continue
+		default:
+		}
+
+		select {
+
+		case apply := <-stm.configure:
+			apply()
+
+		case paused = <-stm.pause:
+			if paused {
+				atomic.StoreInt32(&stm.paused, 1)
+			} else {
+				atomic.StoreInt32(&stm.paused, 0)
+			}
+
+		case ctx := <-drain:
+			draining = nil
+			stm.drain(ctx)
+
+		case <-stm.ctx.Done():
+
+		case <-timeout:
+			stm.timeout = nil
+			stm.process(stm.timeoutMsg)
+			stm.notifyIdle()
+
+		case msg := <-priority:
+			stm.process(msg)
+			stm.processBuffered(stm.batchSize - 1)
+			stm.notifyIdle()
+
+		case msg := <-messages:
+			stm.process(msg)
+			stm.processBuffered(stm.batchSize - 1)
+			stm.notifyIdle()
+
+		case <-stm.wake:
+			stm.notifyIdle()
+		}
+	}
+	stm.shutdown()
+	if stm.emitBatch {
+		stm.emitMu.Lock()
+		stm.flushEmitted()
+		stm.emitMu.Unlock()
+	}
+	if state, ok := stm.state.(ShutdownState); ok {
+		state.OnShutdown()
+	}
+	stm.closeSubscribers()
+}
+
+// runInitialCommands executes the initial commands on the loop and processes
+// their messages before any other message.
+func (stm *Stm) runInitialCommands() {
+	for _, cmd := range stm.initialCmds {
+		if cmd = stm.intercept(cmd); cmd == nil {
+			continue
+		}
+		switch msg := stm.call(cmd); {
+		case msg == nil:
+		case isExpanded(msg):
+			stm.send(ToCmd(msg))
+		default:
+			stm.process(msg)
+		}
+	}
+	stm.initialCmds = nil
+}
+
+// process gives a message to the current state.
+func (stm *Stm) process(msg Msg) {
+	stm.markActivity(1)
+	defer stm.markActivity(0)
+
+	switch m := msg.(type) {
+	case idleWaiter:
+		stm.idleWaiters = append(stm.idleWaiters, m)
+		return
+
+	case yielded:
+		select {
+		case stm.messages <- m.msg:
+		default:
+			stm.send(ToCmd(m.msg))
+		}
+		return
+
+	case quit:
+		stm.cancel(ErrQuit)
+		return
+
+	case throttle:
+		now := stm.clock.Now()
+		stm.sweepThrottled(now)
+		if until, ok := stm.throttled[m.key]; ok && now.Before(until) {
+			return
+		}
+		until := now.Add(m.cooldown)
+		stm.throttled[m.key] = until
+		if stm.throttledSweep.IsZero() || until.Before(stm.throttledSweep) {
+			stm.throttledSweep = until
+		}
+		stm.process(m.msg)
+		return
+
+	case breaker:
+		stm.runBreaker(m)
+		return
+
+	case breakerResult:
+		stm.breakerDone(m)
+		return
+
+	case debounce:
+		stm.sendNamed(stm.debounced, m.key, func(ctx context.Context) Msg {
+			timer := clockFrom(ctx).NewTimer(m.d)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				return m.msg
+			case <-ctx.Done():
+				return nil
+			}
+		})
+		return
+
+	case syncMsg:
+		stm.process(m.msg)
+		close(m.done)
+		return
+
+	case sequenceStep:
+		stm.process(m.msg)
+		if len(m.rest) > 0 {
+			stm.send(ToCmd(m.rest))
+		}
+		return
+
+	case chained:
+		stm.chainDepth = m.depth
+		stm.process(m.msg)
+		stm.chainDepth = 0
+		return
+	}
+
+	for _, middleware := range stm.middlewares {
+		var keep bool
+		if msg, keep = middleware(msg); !keep {
+			return
+		}
+	}
+
+	if stm.dedupKey != nil && stm.duplicate(msg) {
+		return
+	}
+
+	stm.publish(msg)
+	if stm.metrics != nil {
+		stm.metrics.MessageProcessed(msg)
+	}
+
+	prev := stm.state
+	next, cmd := stm.update(prev, msg)
+	switch n := next.(type) {
+	case nil:
+		next = prev
+	case pushed:
+		stm.stack = append(stm.stack, prev)
+		next = n.State
+	case popped:
+		next = prev
+		if len(stm.stack) > 0 {
+			next = stm.stack[len(stm.stack)-1]
+			stm.stack[len(stm.stack)-1] = nil
+			stm.stack = stm.stack[:len(stm.stack)-1]
+		}
+	}
+
+	t, isTransition := transitionOf(cmd)
+	if stm.rewriter != nil {
+		rewritten := stm.rewriter(prev, next, msg)
+		if rewritten != nil && !sameState(rewritten, next) {
+			next = rewritten
+			if !isTransition {
+				t, isTransition = transition{cmds: []Cmd{cmd}}, true
+			}
+			t.state, t.wrap = next, nil
+		}
+	}
+	if isTransition {
+		// Init is called from the loop, so it doesn't run concurrently
+		// with Update and completes before the next message
+		cmd = Batch(t.expand()...)
+	}
+
+	changed := !sameState(prev, next)
+	var diff string
+	if stm.stateDiff != nil && changed {
+		diff = stm.stateDiff(prev, next)
+	}
+	if stm.logger != nil {
+		stm.logger.Log(LogEntry{
+			Msg:     msg,
+			From:    prev,
+			To:      next,
+			HasCmd:  cmd != nil,
+			Changed: changed,
+			Diff:    diff,
+		})
+	}
+
+	if stm.historySize > 0 && changed {
+		stm.record(Transition{From: prev, To: next, At: stm.clock.Now(), Trigger: msg, Diff: diff})
+	}
+	if stm.metrics != nil && changed {
+		stm.metrics.Transition(prev, next)
+	}
+	if stm.onTransition != nil && changed {
+		stm.onTransition(prev, next)
+	}
+
+	if d, ok := msg.(Deadlined); ok && cmd != nil {
+		cmd = withDeadline(cmd, d.Deadline())
+	}
+	if cmd != nil {
+		cmd = stm.chain(cmd)
+	}
+	if exit, ok := prev.(ExitState); ok && changed {
+		if onExit := exit.OnExit(); onExit != nil {
+			cmd = Sequence(onExit, cmd)
+		}
+	}
+
+	stm.stateMu.Lock()
+	stm.state = next
+	if changed && stm.stateChanged != nil {
+		close(stm.stateChanged)
+		stm.stateChanged = nil
+	}
+	stm.stateMu.Unlock()
+	stm.armTimeout()
+	stm.send(cmd)
+
+	if stm.checkpointEvery > 0 && changed {
+		stm.transitions++
+		if stm.transitions%stm.checkpointEvery == 0 {
+			if msg := stm.onCheckpoint(next); msg != nil {
+				stm.send(ToCmd(msg))
+			}
+		}
+	}
+}
+
+// chain tags the messages of the command returned by Update with the depth of
+// the chain, or replaces it with ChainLimitExceeded when the chain is too
+// long.
+func (stm *Stm) chain(cmd Cmd) Cmd {
+	if stm.maxChainDepth <= 0 {
+		return cmd
+	}
+
+	depth := stm.chainDepth + 1
+	if depth > stm.maxChainDepth {
+		return ToCmd(ChainLimitExceeded{Depth: stm.maxChainDepth})
+	}
+	return Map(cmd, func(msg Msg) Msg {
+		return chained{msg: msg, depth: depth}
+	})
+}
+
+// record adds a transition to the history, replacing the oldest one when it
+// is full.
+func (stm *Stm) record(transition Transition) {
+	stm.historyMu.Lock()
+	defer stm.historyMu.Unlock()
+
+	if len(stm.history) < stm.historySize {
+		stm.history = append(stm.history, transition)
+		return
+	}
+	stm.history[stm.historyNext] = transition
+	stm.historyNext = (stm.historyNext + 1) % stm.historySize
+}
+
+// sweepThrottled deletes the keys of Throttle whose cooldown is over, once
+// the earliest cooldown is over.
+func (stm *Stm) sweepThrottled(now time.Time) {
+	if stm.throttledSweep.IsZero() || now.Before(stm.throttledSweep) {
+		return
+	}
+
+	stm.throttledSweep = time.Time{}
+	for key, until := range stm.throttled {
+		switch {
+		case !now.Before(until):
+			delete(stm.throttled, key)
+		case stm.throttledSweep.IsZero() || until.Before(stm.throttledSweep):
+			stm.throttledSweep = until
+		}
+	}
+}
+
+// duplicate reports whether a message with the same key was delivered less
+// than the dedup window ago, and records the message otherwise.
+func (stm *Stm) duplicate(msg Msg) bool {
+	key := stm.dedupKey(msg)
+	if key == "" {
+		return false
+	}
+
+	now := stm.clock.Now()
+	if now.Sub(stm.dedupSwept) >= stm.dedupWindow {
+		for k, seen := range stm.dedupSeen {
+			if now.Sub(seen) >= stm.dedupWindow {
+				delete(stm.dedupSeen, k)
+			}
+		}
+		stm.dedupSwept = now
+	}
+
+	if seen, ok := stm.dedupSeen[key]; ok && now.Sub(seen) < stm.dedupWindow {
+		return true
+	}
+	stm.dedupSeen[key] = now
+	return false
+}
+
+// sameState reports whether a and b are the same state. States that are not
+// comparable, like the ones holding a slice or a map, are compared with
+// reflect.DeepEqual.
+func sameState(a, b State) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	t := reflect.TypeOf(a)
+	switch {
+	case t != reflect.TypeOf(b):
+		return false
+	case !t.Comparable():
+		return reflect.DeepEqual(a, b)
+	case t.Kind() == reflect.Struct || t.Kind() == reflect.Array:
+		// their interface fields may hold values that are not comparable,
+		// checking the values allocates so it is only done for these kinds
+		if !reflect.ValueOf(a).Comparable() || !reflect.ValueOf(b).Comparable() {
+			return reflect.DeepEqual(a, b)
+		}
+	}
+	return a == b
+}
+
+// FieldDiff describes the change between two states, it can be given to
+// WithStateDiff. For two structs, or pointers to structs, of the same type it
+// lists the exported fields that differ as "Field: old -> new", separated by
+// commas. Otherwise it gives the names of the states, or their values when
+// they have the same type.
+func FieldDiff(prev, next State) string {
+	a, b := reflect.ValueOf(prev), reflect.ValueOf(next)
+	if !a.IsValid() || !b.IsValid() || a.Type() != b.Type() {
+		return StateName(prev) + " -> " + StateName(next)
+	}
+	if a.Kind() == reflect.Ptr && !a.IsNil() && !b.IsNil() {
+		a, b = a.Elem(), b.Elem()
+	}
+	if a.Kind() != reflect.Struct {
+		return fmt.Sprintf("%v -> %v", a, b)
+	}
+
+	var changes []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		old, new := a.Field(i).Interface(), b.Field(i).Interface()
+		if !reflect.DeepEqual(old, new) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", field.Name, old, new))
+		}
+	}
+	return strings.Join(changes, ", ")
+}
+
+// armTimeout starts the timer of the current state if it is a TimedState,
+// replacing any previous timer.
+func (stm *Stm) armTimeout() {
+	stm.stopTimeout()
+	if timed, ok := stm.state.(TimedState); ok {
+		var d time.Duration
+		d, stm.timeoutMsg = timed.Timeout()
+		stm.timeout = stm.clock.NewTimer(d)
+	}
+}
+
+func (stm *Stm) stopTimeout() {
+	if stm.timeout != nil {
+		stm.timeout.Stop()
+		stm.timeout = nil
+	}
+}
+
+// timeoutC returns the channel of the timer of the current state, or nil if
+// the state has no timer.
+func (stm *Stm) timeoutC() <-chan time.Time {
+	if stm.timeout == nil {
+		return nil
+	}
+	return stm.timeout.C()
+}
+
+// processBuffered processes up to n messages already in the buffer, without
+// waiting for new ones.
+func (stm *Stm) processBuffered(n int) {
+	for ; n > 0 && stm.ctx.Err() == nil; n-- {
+		msg, ok := stm.nextBuffered()
+		if !ok {
+			return
+		}
+		stm.process(msg)
+	}
+}
+
+// nextBuffered returns a message from the buffers without blocking, the
+// priority messages first.
+func (stm *Stm) nextBuffered() (Msg, bool) {
+	select {
+	case msg := <-stm.priority:
+		return msg, true
+	default:
+	}
+
+	select {
+	case msg := <-stm.priority:
+		return msg, true
+	case msg := <-stm.messages:
+		return msg, true
+	default:
+		return nil, false
+	}
+}
+
+// drain processes the messages until the buffer is empty and no command is
+// running, or until ctx is done, then terminates the state machine.
+func (stm *Stm) drain(ctx context.Context) {
+	defer stm.cancel(ErrShutdown)
+
+	for stm.ctx.Err() == nil {
+		if msg, ok := stm.nextBuffered(); ok {
+			stm.process(msg)
+			stm.notifyIdle()
+			continue
+		}
+		if atomic.LoadInt64(&stm.pending) == 0 {
+			return
+		}
+
+		select {
+		case apply := <-stm.configure:
+			apply()
+		case <-stm.timeoutC():
+			stm.timeout = nil
+			stm.process(stm.timeoutMsg)
+		case msg := <-stm.priority:
+			stm.process(msg)
+		case msg := <-stm.messages:
+			stm.process(msg)
+		case <-stm.wake:
+		case <-ctx.Done():
+			return
+		case <-stm.ctx.Done():
+		}
+		stm.notifyIdle()
+	}
+}
+
+// notifyIdle sends the messages registered with OnceIdle if the state machine
+// is idle. It must be called from the loop.
+func (stm *Stm) notifyIdle() {
+	if len(stm.idleWaiters) == 0 {
+		return
+	}
+	if atomic.LoadInt64(&stm.pending) != 0 || len(stm.messages) != 0 || len(stm.priority) != 0 {
+		return
+	}
+	waiters := stm.idleWaiters
+	stm.idleWaiters = nil
+	for _, waiter := range waiters {
+		if waiter.done != nil {
+			close(waiter.done)
+		} else {
+			stm.send(ToCmd(waiter.msg))
+		}
+	}
+}
+
+// runBreaker executes the command of a breaker, unless it is open or a trial
+// is already running, in which case BreakerOpen is processed instead.
+func (stm *Stm) runBreaker(b breaker) {
+	state, ok := stm.breakers[b.name]
+	if !ok {
+		state = &breakerState{}
+		stm.breakers[b.name] = state
+	}
+
+	if state.trial || (state.failures >= b.threshold && stm.clock.Now().Before(state.openUntil)) {
+		stm.process(BreakerOpen{Name: b.name})
+		return
+	}
+	// half-open after the cooldown, a single command is tried
+	state.trial = state.failures >= b.threshold
+
+	stm.send(func() Msg {
+		// the first message of a command sending over time is the result
+		msg := await(stm.ctx, func() Msg {
+			return stm.call(b.cmd)
+		})
+		return breakerResult{breaker: b, msg: msg}
+	})
+}
+
+// breakerDone updates the state of a breaker with the message of its command,
+// then dispatches the message.
+func (stm *Stm) breakerDone(result breakerResult) {
+	state := stm.breakers[result.name]
+	if result.isFailure(result.msg) {
+		state.failures++
+		if state.failures >= result.threshold {
+			state.openUntil = stm.clock.Now().Add(result.cooldown)
+		}
+	} else {
+		state.failures = 0
+	}
+	state.trial = false
+
+	switch {
+	case result.msg == nil:
+	case isExpanded(result.msg):
+		stm.send(ToCmd(result.msg))
+	default:
+		stm.process(result.msg)
+	}
+}
+
+// publish sends a copy of the message to the subscribers, it is dropped for
+// the subscribers with a full buffer.
+func (stm *Stm) publish(msg Msg) {
+	stm.subscribersMu.Lock()
+	defer stm.subscribersMu.Unlock()
+
+	for ch := range stm.subscribers {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// closeSubscribers closes the channels of all the subscribers.
+func (stm *Stm) closeSubscribers() {
+	stm.subscribersMu.Lock()
+	defer stm.subscribersMu.Unlock()
+
+	for ch := range stm.subscribers {
+		close(ch)
+	}
+	stm.subscribers = nil
+}
+
+// shutdown runs the shutdown command and gives its message to the current
+// state, unless the command takes longer than the shutdown timeout.
+func (stm *Stm) shutdown() {
+	cmd := stm.intercept(stm.shutdownCmd)
+	if cmd == nil {
+		return
+	}
+
+	// the context of the state machine is done, a command sending messages
+	// over time runs with its own context until the timeout and its first
+	// message is the result
+	ctx, cancel := context.WithTimeout(context.Background(), stm.shutdownTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, clockKey{}, stm.clock)
+	ctx = context.WithValue(ctx, senderKey{}, stm)
+
+	result := make(chan Msg, 1)
+	go func() {
+		result <- await(ctx, func() Msg {
+			return stm.call(cmd)
+		})
+	}()
+
+	timer := stm.clock.NewTimer(stm.shutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-result:
+		if msg == nil || isInternal(msg) {
+			return
+		}
+		stm.state.Update(msg)
+
+	case <-timer.C():
+	}
+}
+
+// finish is called when a command goroutine ends.
+func (stm *Stm) finish() {
+	if atomic.AddInt64(&stm.pending, -1) == 0 {
+		select {
+		case stm.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Send a command to the state machine. Note that the execution of the command
+// is done in a goroutine and therefore the order of execution is not guaranteed.
+func (stm *Stm) Send(cmd Cmd) {
+	if stm.closed() {
+		return
+	}
+	stm.send(cmd)
+}
+
+// closed reports whether the commands sent from outside of the state machine
+// are ignored, because it is terminated or shutting down.
+func (stm *Stm) closed() bool {
+	return stm.ctx.Err() != nil || atomic.LoadInt32(&stm.closing) == 1
+}
+
+// SendMsg puts the message in the buffer of the state machine from the
+// calling goroutine, without executing a command. It blocks while the buffer
+// is full, so it must not be called from Update. The messages sent with
+// SendMsg from the same goroutine are processed in order, there is no
+// ordering guarantee with the messages of the commands sent with Send. A nil
+// message is ignored, and the commands of a Batch or a Sequence are dispatched
+// as with Send.
+func (stm *Stm) SendMsg(msg Msg) {
+	if msg == nil || stm.closed() {
+		return
+	}
+	if isExpanded(msg) {
+		stm.send(ToCmd(msg))
+		return
+	}
+	stm.push(msg)
+}
+
+// SendAll sends each command as with Send, independently from the others.
+// Nil commands are ignored.
+func (stm *Stm) SendAll(cmds ...Cmd) {
+	for _, cmd := range cmds {
+		stm.Send(cmd)
+	}
+}
+
+// send dispatches the command and reports whether it was accepted, commands
+// are ignored once the state machine is terminated. Unlike Send, it accepts
+// the commands while shutting down, it is used for the commands of the state
+// machine itself, like the ones returned by Update.
+func (stm *Stm) send(cmd Cmd) bool {
+	if cmd == nil || stm.ctx.Err() != nil {
+		return false
+	}
+	if cmd = stm.intercept(cmd); cmd == nil {
+		return false
+	}
+	atomic.AddInt64(&stm.pending, 1)
+	if stm.synchronous {
+		stm.execute(cmd)
+	} else {
+		stm.run(cmd)
+	}
+	return true
+}
+
+// execute runs a command accepted by send and dispatches its message. The
+// command is given as is to the goroutine running it, without allocating a
+// closure, so handing it to an idle worker doesn't allocate.
+func (stm *Stm) execute(cmd Cmd) {
+	defer stm.finish()
+
+	if stm.metrics == nil {
+		stm.dispatch(stm.call(cmd))
+		return
+	}
+
+	stm.metrics.CommandStarted()
+	start := time.Now()
+	msg := stm.call(cmd)
+	s, ok := msg.(stream)
+	if !ok {
+		stm.metrics.CommandFinished(time.Since(start))
+		stm.dispatch(msg)
+		return
+	}
+	// a command sending messages over time runs until its stream ends
+	stm.dispatch(stream(func(ctx context.Context, send func(Msg)) {
+		defer func() {
+			stm.metrics.CommandFinished(time.Since(start))
+		}()
+		s(ctx, send)
+	}))
+}
+
+// dispatch delivers the message of a command to the loop, expanding batches,
+// sequences and streams.
+func (stm *Stm) dispatch(msg Msg) {
+	switch m := msg.(type) {
+	case nil:
+
+	case batched:
+		// recursively send all commands in the batch, reporting the ones
+		// ignored because the state machine is terminated
+		var undispatched []int
+		for i, batchCmd := range m {
+			if batchCmd != nil && !stm.send(batchCmd) {
+				undispatched = append(undispatched, i)
+			}
+		}
+		if len(undispatched) > 0 {
+			stm.report(UndispatchedError{Indices: undispatched, Size: len(m)})
+		}
+
+	case sequence:
+		stm.runSequence(m)
+
+	case transition:
+		stm.dispatch(m.expand())
+
+	case stream:
+		stm.runStream(func() {
+			stm.deliver(stm.call(func() Msg {
+				m(stm.ctx, stm.sendStream)
+				return nil
+			}))
+		})
+
+	default:
+		stm.push(msg)
+	}
+}
+
+// push puts a message in the buffer, the message is dropped if the state
+// machine terminates while the buffer is full. With synchronous dispatch, the
+// caller may be the loop itself, so when the buffer is full the message is
+// pushed from another goroutine instead of blocking.
+func (stm *Stm) push(msg Msg) {
+	switch stm.bufferPolicy {
+	case DropNewest:
+		select {
+		case stm.messages <- msg:
+		default:
+			stm.report(fmt.Errorf("%w: %T", ErrDropped, msg))
+		}
+		return
+
+	case DropOldest:
+		for stm.ctx.Err() == nil {
+			select {
+			case stm.messages <- msg:
+				return
+			default:
+			}
+			select {
+			case old := <-stm.messages:
+				stm.report(fmt.Errorf("%w: %T", ErrDropped, old))
+			default:
+			}
+		}
+		return
+	}
+
+	if !stm.synchronous {
+		stm.deliver(msg)
+		return
+	}
+
+	select {
+	case stm.messages <- msg:
+	default:
+		go stm.deliver(msg)
+	}
+}
+
+// intercept wraps the command with the command middlewares, the first one
+// registered being the outermost.
+func (stm *Stm) intercept(cmd Cmd) Cmd {
+	for i := len(stm.cmdMiddlewares) - 1; i >= 0 && cmd != nil; i-- {
+		cmd = stm.cmdMiddlewares[i](cmd)
+	}
+	return cmd
+}
+
+// call executes the command. If panic recovery is enabled, a panic is
+// recovered and turned into a CmdPanic message.
+func (stm *Stm) call(cmd Cmd) (msg Msg) {
+	if stm.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err, ok := r.(error)
+				if !ok {
+					err = fmt.Errorf("%v", r)
+				}
+				panicked := CmdPanic{
+					Err:   fmt.Errorf("stm: command panicked: %w", err),
+					Stack: debug.Stack(),
+				}
+				stm.report(panicked.Err)
+				msg = panicked
+			}
+		}()
+	}
+	return cmd()
+}
+
+// report sends an error to the Errors channel, it is dropped if the channel
+// is full.
+func (stm *Stm) report(err error) {
+	select {
+	case stm.errs <- err:
+	default:
+	}
+}
+
+// sendStream delivers a message sent by a stream, the commands of a Batch, a
+// Sequence or a stream it sends are dispatched as with Send.
+func (stm *Stm) sendStream(msg Msg) {
+	if isExpanded(msg) {
+		stm.send(ToCmd(msg))
+		return
+	}
+	stm.deliver(msg)
+}
+
+// deliver sends a message to the loop, unless the state machine is
+// terminated first, in which case the message is reported as dropped.
+func (stm *Stm) deliver(msg Msg) {
+	if msg == nil {
+		return
+	}
+	select {
+	case stm.messages <- msg:
+	case <-stm.ctx.Done():
+		stm.report(fmt.Errorf("%w: %T", ErrDropped, msg))
+	}
+}
+
+// runSequence executes the commands of the sequence until one produces a
+// message, which is delivered with the rest of the sequence.
+func (stm *Stm) runSequence(seq sequence) {
+	for i, cmd := range seq {
+		if stm.ctx.Err() != nil {
+			return
+		}
+		if cmd = stm.intercept(cmd); cmd == nil {
+			continue
+		}
+
+		msg := stm.call(cmd)
+		if s, ok := msg.(stream); ok {
+			// the rest of the sequence waits for the first message sent
+			// over time, or for the end of the stream if it sends none
+			rest := seq[i+1:]
+			stm.runStream(func() {
+				if !stm.runStep(s, rest) {
+					stm.runSequence(rest)
+				}
+			})
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		if isExpanded(msg) {
+			// nested batches and sequences are not waited for
+			stm.send(ToCmd(msg))
+			continue
+		}
+
+		stm.deliverStep(sequenceStep{msg: msg, rest: seq[i+1:]})
+		return
+	}
+}
+
+// runStream executes run, which runs a stream. Streams may not end before the
+// machine, so with synchronous dispatch, a limit of concurrent commands or the
+// deterministic scheduler they run in their own goroutine rather than inline
+// or in a slot of the limited commands.
+func (stm *Stm) runStream(run func()) {
+	if stm.synchronous || stm.maxConcurrent > 0 || stm.random != nil {
+		atomic.AddInt64(&stm.pending, 1)
+		go func() {
+			defer stm.finish()
+			run()
+		}()
+		return
+	}
+	run()
+}
+
+// runStep runs the stream of a step of a sequence, its first message is
+// delivered with the rest of the sequence and the following ones as those
+// of any stream. It reports whether a message carried the rest.
+func (stm *Stm) runStep(s stream, rest sequence) bool {
+	var carried int32
+	s(stm.ctx, func(msg Msg) {
+		if msg != nil && !isExpanded(msg) && atomic.CompareAndSwapInt32(&carried, 0, 1) {
+			stm.deliverStep(sequenceStep{msg: msg, rest: rest})
+			return
+		}
+		stm.sendStream(msg)
+	})
+	return !atomic.CompareAndSwapInt32(&carried, 0, 1)
+}
+
+// deliverStep delivers the message of a step of a sequence.
+func (stm *Stm) deliverStep(step sequenceStep) {
+	if stm.synchronous {
+		stm.push(step)
+	} else {
+		stm.deliver(step)
+	}
+}
+
+// run executes the command in its own goroutine, reusing an idle worker when
+// pooling is enabled.
+func (stm *Stm) run(cmd Cmd) {
+	if stm.random != nil {
+		stm.queueMu.Lock()
+		stm.queue = append(stm.queue, cmd)
+		stm.queueMu.Unlock()
+
+		select {
+		case stm.wakeScheduler <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	if stm.maxConcurrent > 0 {
+		stm.queueMu.Lock()
+		if stm.active >= stm.maxConcurrent {
+			stm.queue = append(stm.queue, cmd)
+			stm.queueMu.Unlock()
+			return
+		}
+		stm.active++
+		stm.queueMu.Unlock()
+
+		go stm.runQueue(cmd)
+		return
+	}
+
+	if stm.workers == nil {
+		go stm.execute(cmd)
+		return
+	}
+
+	select {
+	case stm.workers <- cmd:
+	default:
+		go stm.worker(cmd)
+	}
+}
+
+// runQueue executes the given command, then the queued commands until the
+// queue is empty.
+func (stm *Stm) runQueue(cmd Cmd) {
+	for {
+		stm.execute(cmd)
+
+		stm.queueMu.Lock()
+		if len(stm.queue) == 0 {
+			stm.active--
+			stm.queueMu.Unlock()
+			return
+		}
+		cmd = stm.queue[0]
+		stm.queue[0] = nil
+		stm.queue = stm.queue[1:]
+		stm.queueMu.Unlock()
+	}
+}
+
+// scheduler executes the queued commands one at a time, picking each one
+// among the waiting commands with the random generator of the deterministic
+// scheduler, until the state machine is terminated. The commands still queued
+// then are dropped.
+func (stm *Stm) scheduler(done <-chan struct{}) {
+	for {
+		stm.queueMu.Lock()
+		if len(stm.queue) == 0 {
+			stm.queueMu.Unlock()
+			select {
+			case <-stm.wakeScheduler:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case <-done:
+			for range stm.queue {
+				stm.finish()
+			}
+			stm.queue = nil
+			stm.queueMu.Unlock()
+			return
+		default:
+		}
+
+		i := stm.random.Intn(len(stm.queue))
+		cmd := stm.queue[i]
+		stm.queue = append(stm.queue[:i], stm.queue[i+1:]...)
+		stm.queueMu.Unlock()
+
+		stm.execute(cmd)
+	}
+}
+
+// worker executes the given command, then waits for the next one until it is
+// idle for longer than WorkerIdleTimeout or the state machine is terminated.
+func (stm *Stm) worker(cmd Cmd) {
+	// the context is read before the command, Restart may replace it once
+	// the command is done
+	done := stm.ctx.Done()
+
+	timer := time.NewTimer(WorkerIdleTimeout)
+	defer timer.Stop()
+
+	for {
+		stm.execute(cmd)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(WorkerIdleTimeout)
+
+		select {
+		case cmd = <-stm.workers:
+		case <-timer.C:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// SendSync executes the command in the calling goroutine, sends its message
+// to the state machine and waits until Update has processed it. Commands
+// returned by Update are dispatched as usual and not waited for. If the
+// command produces a Batch or a Sequence, its commands are dispatched as with
+// Send and SendSync returns without waiting. A command sending messages over
+// time, like Timer or ContextCmd, runs in the calling goroutine and SendSync
+// returns once it is done and each of its messages is processed, so it only
+// returns with the termination of the machine for a command like Tick.
+// ErrTerminated is returned if the state machine is terminated before the
+// message is processed.
+func (stm *Stm) SendSync(cmd Cmd) error {
+	if stm.closed() {
+		return ErrTerminated
+	}
+	if cmd = stm.intercept(cmd); cmd == nil {
+		return nil
+	}
+
+	msg := stm.call(cmd)
+	if msg == nil {
+		return nil
+	}
+	if s, ok := msg.(stream); ok {
+		return stm.syncStream(s)
+	}
+	if isExpanded(msg) {
+		stm.send(ToCmd(msg))
+		return nil
+	}
+	return stm.deliverSync(msg)
+}
+
+// syncStream runs the stream in the calling goroutine, counted as a running
+// command, and waits for each of its messages to be processed. It returns
+// ErrTerminated if the state machine is terminated before a message could be
+// processed.
+func (stm *Stm) syncStream(s stream) error {
+	atomic.AddInt64(&stm.pending, 1)
+	defer stm.finish()
+
+	var (
+		mu        sync.Mutex
+		err       error
+		delivered bool
+	)
+	s(stm.ctx, func(msg Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case msg == nil || err != nil:
+		case isExpanded(msg):
+			stm.send(ToCmd(msg))
+		default:
+			err = stm.deliverSync(msg)
+			delivered = err == nil
+		}
+	})
+	if err == nil && !delivered && stm.ctx.Err() != nil {
+		return ErrTerminated
+	}
+	return err
+}
+
+// deliverSync sends the message to the loop and waits until Update has
+// processed it.
+func (stm *Stm) deliverSync(msg Msg) error {
+	done := make(chan struct{})
+	select {
+	case stm.messages <- syncMsg{msg: msg, done: done}:
+	case <-stm.ctx.Done():
+		return ErrTerminated
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-stm.stopped:
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrTerminated
+		}
+	}
+}
+
+// WaitIdle blocks until the state machine is idle: no command is running, the
+// buffer is empty and the loop is not processing a message, as with
+// OnceIdle. Commands running until the termination of the machine, like
+// Tick, prevent it from being idle. It returns the error of the given context
+// if it is done first, or ErrTerminated if the state machine is terminated.
+func (stm *Stm) WaitIdle(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case stm.messages <- idleWaiter{done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stm.ctx.Done():
+		return ErrTerminated
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stm.stopped:
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrTerminated
+		}
+	}
+}
+
+// Subscribe returns a channel receiving a copy of each message given to
+// Update, in the order they are processed, and a function to unsubscribe.
+// Each subscriber has a buffer of DefaultMessageBufferSize messages, the
+// messages are dropped for a subscriber while its buffer is full so a slow
+// subscriber never stalls the state machine. The channel is closed when
+// unsubscribing or when the state machine is terminated.
+func (stm *Stm) Subscribe() (<-chan Msg, func()) {
+	ch := make(chan Msg, DefaultMessageBufferSize)
+
+	stm.subscribersMu.Lock()
+	defer stm.subscribersMu.Unlock()
+
+	if stm.subscribers == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	stm.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		stm.subscribersMu.Lock()
+		defer stm.subscribersMu.Unlock()
+
+		if _, ok := stm.subscribers[ch]; ok {
+			delete(stm.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// TrySend sends a command to the state machine without blocking on a full
+// buffer. The returned channel receives true when the message of the command
+// is accepted in the buffer, or false when it is dropped because the buffer is
+// full or the state machine is terminated. Reading the channel is optional.
+// A command producing nil, a Batch or a Sequence is dispatched as with Send
+// and reported as accepted. For a command sending messages over time, like
+// ContextCmd, each message is dropped while the buffer is full and the
+// channel receives the outcome of the first one, or true if it sends none.
+func (stm *Stm) TrySend(cmd Cmd) <-chan bool {
+	accepted := make(chan bool, 1)
+	if cmd == nil {
+		accepted <- true
+		return accepted
+	}
+	if stm.closed() {
+		accepted <- false
+		return accepted
+	}
+
+	sent := stm.send(func() Msg {
+		msg := stm.call(cmd)
+		if s, ok := msg.(stream); ok {
+			return stream(func(ctx context.Context, send func(Msg)) {
+				var once sync.Once
+				report := func(ok bool) {
+					once.Do(func() { accepted <- ok })
+				}
+				defer report(true)
+
+				s(ctx, func(msg Msg) {
+					if msg == nil || isExpanded(msg) {
+						send(msg)
+						return
+					}
+					report(stm.tryPush(msg))
+				})
+			})
+		}
+		if msg == nil || isExpanded(msg) {
+			accepted <- true
+			return msg
+		}
+		accepted <- stm.tryPush(msg)
+		return nil
+	})
+	if !sent {
+		accepted <- false
+	}
+	return accepted
+}
+
+// tryPush puts the message in the buffer unless it is full or the state
+// machine is terminated, and reports whether it did.
+func (stm *Stm) tryPush(msg Msg) bool {
+	if stm.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case stm.messages <- msg:
+		return true
+	default:
+		stm.report(fmt.Errorf("%w: %T", ErrDropped, msg))
+		return false
+	}
+}
+
+// SendPriority works like Send but the message of the command is processed
+// before the messages waiting in the regular buffer, after the priority
+// messages sent before it. A command producing a Batch or a Sequence has its
+// commands dispatched as with Send, without priority.
+func (stm *Stm) SendPriority(cmd Cmd) {
+	if cmd == nil || stm.closed() {
+		return
+	}
+
+	stm.send(func() Msg {
+		msg := stm.call(cmd)
+		if msg == nil || isExpanded(msg) {
+			return msg
+		}
+
+		deliver := func() {
+			select {
+			case stm.priority <- msg:
+			case <-stm.ctx.Done():
+			}
+		}
+		select {
+		case stm.priority <- msg:
+		default:
+			// with synchronous dispatch the caller may be the loop
+			if stm.synchronous {
+				go deliver()
+			} else {
+				deliver()
+			}
+		}
+		return nil
+	})
+}
+
+// Request sends the command to the state machine and waits for its message,
+// which is returned to the caller as well as processed by the state machine.
+// Unlike SendSync, it doesn't wait for Update to process the message. If the
+// command produces nil, a Batch, a Sequence or another message of this
+// package that is not delivered to Update as is, it is dispatched as with Send
+// and nil is returned. For a command sending messages over time, like Timer or
+// Tick, the first message is returned, or nil if the command completes
+// without sending any. The error of ctx is
+// returned if it is done first, and ErrTerminated if the state machine is
+// terminated first.
+func (stm *Stm) Request(ctx context.Context, cmd Cmd) (Msg, error) {
+	if stm.closed() {
+		return nil, ErrTerminated
+	}
+	if cmd == nil {
+		return nil, nil
+	}
+
+	reply := make(chan Msg, 1)
+	answer := func(msg Msg) {
+		select {
+		case reply <- msg:
+		default:
+		}
+	}
+	stm.send(func() Msg {
+		msg := cmd()
+		if s, ok := msg.(stream); ok {
+			return stream(func(ctx context.Context, send func(Msg)) {
+				defer answer(nil)
+				s(ctx, func(msg Msg) {
+					if msg != nil && !isInternal(msg) {
+						answer(msg)
+					}
+					send(msg)
+				})
+			})
+		}
+		if isInternal(msg) {
+			answer(nil)
+		} else {
+			answer(msg)
+		}
+		return msg
+	})
+
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-stm.ctx.Done():
+		return nil, ErrTerminated
+	}
+}
+
+// SendCtx sends a command receiving the context of the state machine, which
+// is done when the state machine is terminated. The message of a command
+// returning after the termination is discarded.
+func (stm *Stm) SendCtx(cmd CmdCtx) {
+	if cmd == nil {
+		return
+	}
+	stm.Send(func() Msg {
+		msg := cmd(stm.ctx)
+		if stm.ctx.Err() != nil {
+			return nil
+		}
+		return msg
+	})
+}
+
+// SendNamed sends a command that can be cancelled with CancelNamed. The context
+// given to the command is done when it is cancelled or when the state machine
+// is terminated, the message of a cancelled command is discarded. Sending a
+// command with the name of a running command cancels the running one.
+func (stm *Stm) SendNamed(name string, cmd CmdCtx) {
+	if stm.closed() {
+		return
+	}
+	stm.sendNamed(stm.named, name, cmd)
+}
+
+// sendNamed sends a cancelable command registered under name in commands,
+// which must be guarded by namedMu.
+func (stm *Stm) sendNamed(commands map[string]*namedCmd, name string, cmd CmdCtx) {
+	if cmd == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(stm.ctx)
+	named := &namedCmd{cancel: cancel}
+
+	stm.namedMu.Lock()
+	if running, ok := commands[name]; ok {
+		running.cancel()
+	}
+	commands[name] = named
+	stm.namedMu.Unlock()
+
+	stm.send(func() Msg {
+		msg := cmd(ctx)
+
+		stm.namedMu.Lock()
+		if commands[name] == named {
+			delete(commands, name)
+		}
+		stm.namedMu.Unlock()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		cancel()
+		return msg
+	})
+}
+
+// CancelNamed cancels the command sent with SendNamed under the given name.
+// It does nothing if there is no such command running.
+func (stm *Stm) CancelNamed(name string) {
+	stm.cancelNamed(stm.named, name)
+}
+
+// cancelNamed cancels the command registered under name in commands, which
+// must be guarded by namedMu.
+func (stm *Stm) cancelNamed(commands map[string]*namedCmd, name string) {
+	stm.namedMu.Lock()
+	defer stm.namedMu.Unlock()
+
+	if running, ok := commands[name]; ok {
+		running.cancel()
+		delete(commands, name)
+	}
+}
+
+// New creates and starts a state machine with the initial state and options.
+// The state machine will be terminated when the context is done.
+func New(ctx context.Context, initialState State, opts ...StmOptions) *Stm {
+	stm := &Stm{
+		messages:  make(chan Msg, DefaultMessageBufferSize),
+		priority:  make(chan Msg, DefaultPriorityBufferSize),
+		wake:      make(chan struct{}, 1),
+		pause:     make(chan bool),
+		configure: make(chan func()),
+		errs:      make(chan error, DefaultMessageBufferSize),
+
+		batchSize: 1,
+		clock:     realClock{},
+	}
+
+	for _, opt := range opts {
+		opt(stm)
+	}
+
+	stm.start(ctx, initialState)
+	return stm
+}
+
+// start resets the state of a run of the state machine and starts the loop.
+func (stm *Stm) start(ctx context.Context, initialState State) {
+	stm.stateMu.Lock()
+	stm.state = initialState
+	stm.stateMu.Unlock()
+
+	stm.stopped = make(chan struct{})
+	stm.draining = make(chan context.Context, 1)
+	atomic.StoreInt32(&stm.closing, 0)
+	stm.shutdownOnce = sync.Once{}
+	stm.idleWaiters = nil
+	stm.timeout = nil
+	stm.transitions = 0
+	stm.stack = nil
+	stm.throttled = map[string]time.Time{}
+	stm.throttledSweep = time.Time{}
+	stm.breakers = map[string]*breakerState{}
+	if stm.dedupKey != nil {
+		stm.dedupSeen = map[string]time.Time{}
+	}
+
+	stm.namedMu.Lock()
+	stm.named = map[string]*namedCmd{}
+	stm.debounced = map[string]*namedCmd{}
+	stm.timers = map[string]*namedCmd{}
+	stm.namedMu.Unlock()
+
+	stm.subscribersMu.Lock()
+	stm.subscribers = map[chan Msg]struct{}{}
+	stm.subscribersMu.Unlock()
+
+	stm.onceMu.Lock()
+	stm.onceKeys = map[string]struct{}{}
+	stm.onceMu.Unlock()
+
+	stm.buffersMu.Lock()
+	stm.buffers = map[string]*itemBuffer{}
+	stm.buffersMu.Unlock()
+
+	// the clock is carried by the context for the commands
+	ctx = context.WithValue(ctx, clockKey{}, stm.clock)
+	ctx = context.WithValue(ctx, senderKey{}, stm)
+	stm.ctx, stm.cancel = context.WithCancelCause(ctx)
+
+	atomic.StoreInt32(&stm.paused, 0)
+	stm.markActivity(0)
+	if stm.watchdogTimeout > 0 {
+		go stm.watchdog(stm.ctx.Done())
+	}
+
+	if stm.maxLifetime > 0 {
+		cancel := stm.cancel
+		timer := stm.clock.NewTimer(stm.maxLifetime)
+		done := stm.ctx.Done()
+		go func() {
+			defer timer.Stop()
+			select {
+			case <-timer.C():
+				cancel(ErrLifetimeExceeded)
+			case <-done:
+			}
+		}()
+	}
+
+	if stm.random != nil {
+		go stm.scheduler(stm.ctx.Done())
+	}
+	go stm.loop()
+}
+
+// Restart starts again a terminated state machine with a new context and
+// initial state. The messages left in the buffers, the running timers of
+// Debounce and Throttle and the subscribers of the previous run are dropped,
+// the options are kept. The initial commands are not executed again.
+// ErrRunning is returned if the loop or a command of the previous run is
+// still running. Restart must not be called concurrently with the other
+// methods.
+func (stm *Stm) Restart(ctx context.Context, initialState State) error {
+	select {
+	case <-stm.stopped:
+	default:
+		return ErrRunning
+	}
+	if atomic.LoadInt64(&stm.pending) != 0 {
+		return ErrRunning
+	}
+
+	for len(stm.messages) > 0 {
+		<-stm.messages
+	}
+	for len(stm.priority) > 0 {
+		<-stm.priority
+	}
+
+	stm.start(ctx, initialState)
+	return nil
+}
+
+// NewChild creates and starts a state machine bound to parent: it is
+// terminated when the parent is terminated, or when the parent's context is
+// done, whichever comes first. Terminating the child doesn't affect the
+// parent. The states of the child can hold the parent as a Sender and use
+// Forward to send messages to it, and the parent can do the same with the
+// child.
+func NewChild(parent *Stm, initialState State, opts ...StmOptions) *Stm {
+	return New(parent.ctx, initialState, opts...)
+}
+
+// update gives the message to the state, timing the call when an update
+// timeout is set.
+func (stm *Stm) update(state State, msg Msg) (State, Cmd) {
+	if stm.updateTimeout <= 0 {
+		return state.Update(msg)
+	}
+
+	start := time.Now()
+	next, cmd := state.Update(msg)
+	if elapsed := time.Since(start); elapsed > stm.updateTimeout {
+		stm.onSlow(msg, elapsed)
+	}
+	return next, cmd
+}
+
+// markActivity records the current time as the last activity of the loop and
+// whether it is processing a message.
+func (stm *Stm) markActivity(busy int32) {
+	atomic.StoreInt64(&stm.lastActivity, stm.clock.Now().UnixNano())
+	atomic.StoreInt32(&stm.busy, busy)
+}
+
+// LastActivity returns when the loop last started or finished processing a
+// message, or when the state machine was started if it hasn't processed any.
+func (stm *Stm) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&stm.lastActivity))
+}
+
+// watchdog calls onStuck when the loop has been processing a message, or has
+// left messages in the buffer while not paused, for longer than the watchdog
+// timeout. It is called once per stall, until done is closed.
+func (stm *Stm) watchdog(done <-chan struct{}) {
+	period := stm.watchdogTimeout / 2
+	if period <= 0 {
+		period = stm.watchdogTimeout
+	}
+	ticker := stm.clock.NewTicker(period)
+	defer ticker.Stop()
+
+	var reported int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+
+		last := atomic.LoadInt64(&stm.lastActivity)
+		waiting := atomic.LoadInt32(&stm.paused) == 0 && len(stm.messages)+len(stm.priority) > 0
+		if atomic.LoadInt32(&stm.busy) == 0 && !waiting {
+			continue
+		}
+		if last != reported && stm.clock.Now().Sub(time.Unix(0, last)) >= stm.watchdogTimeout {
+			reported = last
+			stm.onStuck()
+		}
+	}
+}
+
+// Pause stops the processing of messages until Resume is called. Commands
+// keep running and their messages wait in the buffer, so commands block once
+// it is full. The timeout of a TimedState expiring while paused is processed
+// after Resume, and so is a Shutdown. Pause must not be called from Update.
+func (stm *Stm) Pause() {
+	stm.setPaused(true)
+}
+
+// Resume restarts the processing of messages after Pause. It must not be
+// called from Update.
+func (stm *Stm) Resume() {
+	stm.setPaused(false)
+}
+
+// setPaused waits for the loop to take the pause request, unless the state
+// machine is terminated.
+func (stm *Stm) setPaused(paused bool) {
+	select {
+	case stm.pause <- paused:
+	case <-stm.stopped:
+	}
+}
+
+// SetLogger replaces the logger of the state machine, see WithLogger. A nil
+// logger disables the logging. The messages processed after SetLogger returns
+// are given to the new logger. It must not be called from Update.
+func (stm *Stm) SetLogger(logger Logger) {
+	stm.reconfigure(func() {
+		stm.logger = logger
+	})
+}
+
+// SetMiddleware replaces the middlewares of the state machine, see
+// WithMiddleware. The messages processed after SetMiddleware returns go
+// through the new middlewares. It must not be called from Update.
+func (stm *Stm) SetMiddleware(middlewares ...func(Msg) (Msg, bool)) {
+	stm.reconfigure(func() {
+		stm.middlewares = middlewares
+	})
+}
+
+// reconfigure applies the change from the loop, or directly once the state
+// machine is terminated.
+func (stm *Stm) reconfigure(apply func()) {
+	select {
+	case stm.configure <- apply:
+	case <-stm.stopped:
+		apply()
+	}
+}
+
+// Shutdown stops the state machine gracefully: the commands sent from outside
+// of the state machine are ignored, while the messages already in the buffer
+// are processed and the running commands are waited for, including the ones
+// returned by Update during the shutdown. Once the buffer is empty and no
+// command is running, or once the given context is done, the state machine is
+// terminated with the reason ErrShutdown. It returns once the loop has
+// exited, or with the error of the given context if it is done first.
+// Commands running until the termination of the machine, like Tick, keep it
+// draining until the context is done.
+func (stm *Stm) Shutdown(ctx context.Context) error {
+	stm.shutdownOnce.Do(func() {
+		atomic.StoreInt32(&stm.closing, 1)
+		stm.draining <- ctx
+	})
+
+	select {
+	case <-stm.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed once the state machine is terminated
+// and its loop has exited.
+func (stm *Stm) Done() <-chan struct{} {
+	return stm.stopped
+}
+
+// State returns the current state of the state machine. It reflects all the
+// messages processed so far.
+func (stm *Stm) State() State {
+	stm.stateMu.RLock()
+	defer stm.stateMu.RUnlock()
+	return stm.state
+}
+
+// Step gives the message to Update of the current state from the calling
+// goroutine and returns its result, as a pure transition function for tests.
+// It bypasses the loop: the state of the state machine is not changed, the
+// command is not executed and the middlewares and hooks are not called. The
+// state is resolved as the loop would: a nil state returned by Update is
+// replaced by the current state, the state given to Push is returned and Pop
+// returns the state saved by the last Push, or the current state if there is
+// none. Update must not run concurrently, so Step is meant for a paused or
+// terminated state machine, or one whose states are safe for concurrent use.
+func (stm *Stm) Step(msg Msg) (State, Cmd) {
+	state := stm.State()
+	next, cmd := state.Update(msg)
+	switch n := next.(type) {
+	case nil:
+		next = state
+	case pushed:
+		next = n.State
+	case popped:
+		next = state
+		if len(stm.stack) > 0 {
+			next = stm.stack[len(stm.stack)-1]
+		}
+	}
+	return next, cmd
+}
+
+// Log calls f with the entry.
+func (f LoggerFunc) Log(entry LogEntry) {
+	f(entry)
+}
+
+// History returns a copy of the last transitions recorded with WithHistory,
+// from the oldest to the most recent.
+func (stm *Stm) History() []Transition {
+	stm.historyMu.Lock()
+	defer stm.historyMu.Unlock()
+
+	history := make([]Transition, 0, len(stm.history))
+	history = append(history, stm.history[stm.historyNext:]...)
+	return append(history, stm.history[:stm.historyNext]...)
+}
+
+// ExportHistory returns the transitions of History as a JSON array, for
+// auditing. Each transition has the names of the states given by StateName,
+// the time of the transition, the type of the message that triggered it and
+// the message itself when it can be marshaled to JSON.
+func (stm *Stm) ExportHistory() ([]byte, error) {
+	history := stm.History()
+	entries := make([]historyEntry, len(history))
+	for i, transition := range history {
+		entries[i] = historyEntry{
+			From:    StateName(transition.From),
+			To:      StateName(transition.To),
+			At:      transition.At,
+			Trigger: fmt.Sprintf("%T", transition.Trigger),
+			Diff:    transition.Diff,
+		}
+		if transition.Trigger != nil {
+			if msg, err := json.Marshal(transition.Trigger); err == nil {
+				entries[i].Msg = msg
+			}
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// ContextFromStm returns the context of the state machine. It is derived from
+// the context given to New, so it carries its values, and it is done when the
+// state machine is terminated. It is the context given to the commands sent
+// with SendCtx, ContextCmd and SendNamed, so request-scoped values like trace
+// IDs can be attached to the context given to New and read by the commands.
+func ContextFromStm(stm *Stm) context.Context {
+	return stm.ctx
+}
+
+// QueueLen returns the number of messages waiting in the buffer, without the
+// priority messages. It can be used to monitor the backpressure.
+func (stm *Stm) QueueLen() int {
+	return len(stm.messages)
+}
+
+// QueueCap returns the size of the message buffer, see
+// WithMessageBufferSize.
+func (stm *Stm) QueueCap() int {
+	return cap(stm.messages)
+}
+
+// Errors returns a channel receiving the failures that don't reach Update
+// directly:
+//   - the panics recovered with WithPanicRecovery, also sent as a CmdPanic;
+//   - the messages dropped because the buffer is full, by TrySend or by the
+//     DropNewest and DropOldest policies of WithFullBufferPolicy, and the
+//     messages still waiting for room in the buffer when the state machine
+//     is terminated, reported as ErrDropped;
+//   - the commands of a Batch that are not dispatched because the state
+//     machine is terminated, reported with an UndispatchedError.
+//
+// The channel has a buffer of DefaultMessageBufferSize errors, new errors are
+// discarded while it is full so reading it is optional. It is never closed.
+func (stm *Stm) Errors() <-chan error {
+	return stm.errs
+}
+
+// Err returns the reason why the state machine was terminated, or nil if it
+// is still running. The reason is the error of the context unless the
+// machine stopped because of WithMaxLifetime, Shutdown or Quit, then it is
+// ErrLifetimeExceeded, ErrShutdown or ErrQuit.
+func (stm *Stm) Err() error {
+	return context.Cause(stm.ctx)
+}
+
+// WithMessageBufferSize sets the size of the message buffer
+func WithMessageBufferSize(size int) StmOptions {
+	return func(stm *Stm) {
+		stm.messages = make(chan Msg, size)
+	}
+}
+
+// WithPriorityBufferSize sets the size of the buffer of the messages sent
+// with SendPriority.
+func WithPriorityBufferSize(size int) StmOptions {
+	return func(stm *Stm) {
+		stm.priority = make(chan Msg, size)
+	}
+}
+
+// WithEmitBatch makes Emit send the messages to the parent in batches, as an
+// EmitBatch, to reduce the overhead of a high frequency of messages. A batch
+// is flushed once it holds size messages, or flush after its first message
+// following the Clock of the state machine. A size of 0 or less doesn't
+// flush by size, and a flush of 0 or less doesn't flush by time. The
+// remaining messages are flushed when the state machine is terminated.
+func WithEmitBatch(size int, flush time.Duration) StmOptions {
+	return func(stm *Stm) {
+		stm.emitBatch = true
+		stm.emitSize = size
+		stm.emitFlush = flush
+	}
+}
+
+// WithShutdownCommand sets a command that is executed when the context of the
+// state machine is done. The loop waits up to timeout, following the Clock of
+// the state machine, for the command to complete and gives the resulting
+// message to the current state, the command returned by Update is not
+// executed. A command sending messages over time, like ContextCmd or Timer,
+// receives a context canceled after timeout and its first message is the
+// result. Messages still in the buffer when the context is done are
+// discarded, they are not processed before the shutdown command. With
+// Shutdown, the buffer is drained before the shutdown command runs. As the
+// other commands, it goes through the command middlewares and its panics are
+// recovered with WithPanicRecovery.
+func WithShutdownCommand(cmd Cmd, timeout time.Duration) StmOptions {
+	return func(stm *Stm) {
+		stm.shutdownCmd = cmd
+		stm.shutdownTimeout = timeout
+	}
+}
+
+// WithMaxLifetime terminates the state machine after the given duration,
+// following its Clock, regardless of its state. The cancellation of the
+// context still terminates the machine before, the first to happen sets the
+// reason returned by Err.
+func WithMaxLifetime(d time.Duration) StmOptions {
+	return func(stm *Stm) {
+		stm.maxLifetime = d
+	}
+}
+
+// WithBatchProcessing makes the loop process up to k messages already in the
+// buffer before waiting for the next one. Messages are still given to Update
+// one by one and in order, only the scheduling of the loop changes.
+func WithBatchProcessing(k int) StmOptions {
+	return func(stm *Stm) {
+		if k > 1 {
+			stm.batchSize = k
+		}
+	}
+}
+
+// WithPooling reuses the goroutines executing the commands instead of starting
+// a new one for each command. A worker goroutine waits WorkerIdleTimeout for
+// a new command before exiting. The commands still run concurrently, there
+// is no limit on the number of workers. Handing a command to an idle worker
+// doesn't allocate, unlike starting a goroutine.
+func WithPooling() StmOptions {
+	return func(stm *Stm) {
+		stm.workers = make(chan Cmd)
+	}
+}
+
+// WithMaxConcurrentCommands limits the number of commands executed at the same
+// time to n, the commands sent beyond the limit are queued and executed in
+// order as running ones complete. Commands producing messages over time, like
+// Tick, don't count toward the limit. Blocking commands delay all the queued
+// ones, including the commands returned by Update. It takes precedence over
+// WithPooling. If n <= 0 the number of commands is not limited.
+func WithMaxConcurrentCommands(n int) StmOptions {
+	return func(stm *Stm) {
+		stm.maxConcurrent = n
+	}
+}
+
+// WithTransitionRewriter sets a function called after each Update with the
+// current state, the state returned by Update and the message that caused
+// the transition. The state it returns replaces the one returned by Update.
+// Returning the same state, or nil, keeps the state returned by Update. When
+// the state is replaced, its Init command is executed as well as the command
+// returned by Update, without the Init command of the state given to
+// TransitionTo by Update.
+func WithTransitionRewriter(rewriter func(from, to State, cause Msg) State) StmOptions {
+	return func(stm *Stm) {
+		stm.rewriter = rewriter
+	}
+}
+
+// WithMiddleware adds a function called from the loop with every message
+// before it is given to the current state. The message it returns is passed
+// to Update instead, returning false drops the message. Middlewares are
+// called in the order they are registered, see WithMiddlewarePrepend to run
+// one before those already registered. The messages sent with SendPriority go
+// through the same middlewares once they are taken from the priority buffer,
+// a middleware sees them before the regular messages but can't change their
+// priority.
+func WithMiddleware(middleware func(Msg) (Msg, bool)) StmOptions {
+	return WithMiddlewareAppend(middleware)
+}
+
+// WithMiddlewareAppend adds a middleware called after the middlewares
+// already registered, it is the same as WithMiddleware.
+func WithMiddlewareAppend(middleware func(Msg) (Msg, bool)) StmOptions {
+	return func(stm *Stm) {
+		stm.middlewares = append(stm.middlewares, middleware)
+	}
+}
+
+// WithMiddlewarePrepend adds a middleware called before the middlewares
+// already registered, to filter the messages before a logging middleware
+// for instance. The options are applied in order: a middleware prepended
+// after another one is called first.
+func WithMiddlewarePrepend(middleware func(Msg) (Msg, bool)) StmOptions {
+	return func(stm *Stm) {
+		stm.middlewares = append([]func(Msg) (Msg, bool){middleware}, stm.middlewares...)
+	}
+}
+
+// WithCommandMiddleware adds a function wrapping every command before it is
+// executed, to add tracing or a timeout to all the commands for instance.
+// Returning nil drops the command. Middlewares are composed in the order they
+// are registered, the first one being the outermost. A command producing a
+// Batch or a Sequence is wrapped, and so is each of its commands once they are
+// dispatched. The wrapped command runs in the goroutine of the command.
+func WithCommandMiddleware(middleware func(Cmd) Cmd) StmOptions {
+	return func(stm *Stm) {
+		stm.cmdMiddlewares = append(stm.cmdMiddlewares, middleware)
+	}
+}
+
+// WithDedup drops the messages with the same key as a message delivered less
+// than window ago, the key of a message is given by keyFn. Dropped messages
+// don't extend the window. Messages for which keyFn returns an empty string
+// are never dropped. It is applied after the middlewares, right before
+// Update.
+func WithDedup(window time.Duration, keyFn func(Msg) string) StmOptions {
+	return func(stm *Stm) {
+		stm.dedupWindow = window
+		stm.dedupKey = keyFn
+		stm.dedupSeen = map[string]time.Time{}
+	}
+}
+
+// WithHistory records the last n transitions, returned by History. The
+// history is disabled when n <= 0, which is the default.
+func WithHistory(n int) StmOptions {
+	return func(stm *Stm) {
+		stm.historySize = n
+	}
+}
+
+// WithMetrics sets the Metrics receiving the counts and timings of the state
+// machine.
+func WithMetrics(metrics Metrics) StmOptions {
+	return func(stm *Stm) {
+		stm.metrics = metrics
+	}
+}
+
+// WithStateDiff sets a function called from the loop on each transition to
+// describe the change between the previous and the next state, FieldDiff
+// compares their exported fields for instance. The description is given to
+// the Logger in LogEntry.Diff and recorded in Transition.Diff with
+// WithHistory. No diff is computed by default.
+func WithStateDiff(diff func(prev, next State) string) StmOptions {
+	return func(stm *Stm) {
+		stm.stateDiff = diff
+	}
+}
+
+// WithOnTransition sets a function called from the loop each time Update
+// returns a different state, with the previous and the new state. It is not
+// called when the state is unchanged. States are compared as for ExitState.
+// The calls are made in the order of the transitions, blocking in the
+// function stalls the state machine.
+func WithOnTransition(onTransition func(from, to State)) StmOptions {
+	return func(stm *Stm) {
+		stm.onTransition = onTransition
+	}
+}
+
+// WithTransitionCheckpoint calls onCheckpoint with the new state every n
+// transitions and sends the returned message to the state machine.
+// onCheckpoint is called from the loop so it can safely read the state, and
+// nothing is sent when it returns nil. If n <= 0 checkpoints are disabled.
+func WithTransitionCheckpoint(n int, onCheckpoint func(State) Msg) StmOptions {
+	return func(stm *Stm) {
+		stm.checkpointEvery = n
+		stm.onCheckpoint = onCheckpoint
+	}
+}
+
+// WithFullBufferPolicy sets what happens to the message of a command when the
+// message buffer is full. The dropped messages are reported on the Errors
+// channel with ErrDropped. With DropOldest any buffered message can be
+// evicted, including the messages of Quit or WaitIdle, so it is meant for
+// state machines receiving streams of data where only the latest matter. The
+// messages of SendPriority and of the streams, like Tick or FromChannel,
+// always wait for room in their buffer.
+func WithFullBufferPolicy(policy FullBufferPolicy) StmOptions {
+	return func(stm *Stm) {
+		stm.bufferPolicy = policy
+	}
+}
+
+// WithWatchdog calls onStuck when no message is processed for timeout while
+// the loop is busy, because Update blocks or messages are waiting in the
+// buffer. It is called once per stall, from its own goroutine, and is not
+// called while the state machine is paused. The watchdog follows the Clock
+// of the state machine.
+func WithWatchdog(timeout time.Duration, onStuck func()) StmOptions {
+	return func(stm *Stm) {
+		stm.watchdogTimeout = timeout
+		stm.onStuck = onStuck
+	}
+}
+
+// WithUpdateTimeout calls onSlow with the message and the duration of the
+// call when Update takes longer than d. Update can't be interrupted, so
+// onSlow is called from the loop once Update returns, see WithWatchdog to
+// detect an Update that never returns.
+func WithUpdateTimeout(d time.Duration, onSlow func(Msg, time.Duration)) StmOptions {
+	return func(stm *Stm) {
+		stm.updateTimeout = d
+		stm.onSlow = onSlow
+	}
+}
+
+// WithMaxChainDepth limits the chains of messages produced by the commands
+// returned by Update, to stop a state that keeps answering its own messages.
+// A message sent from outside starts a chain, and each message produced by
+// the command returned by Update for a message of the chain extends it. Once
+// n messages are chained, the command returned by Update is not executed and
+// a ChainLimitExceeded message is sent instead, starting a new chain. The
+// messages of the commands sent with Send from a command, like the ones of
+// Once, start a new chain. If n <= 0 the chains are not limited.
+func WithMaxChainDepth(n int) StmOptions {
+	return func(stm *Stm) {
+		stm.maxChainDepth = n
+	}
+}
+
+// WithPanicRecovery recovers the panics of the commands and sends a CmdPanic
+// message to the state machine instead of crashing the program.
+func WithPanicRecovery() StmOptions {
+	return func(stm *Stm) {
+		stm.recoverPanics = true
+	}
+}
+
+// WithInitialCommands sets commands executed when the state machine starts.
+// They are executed one by one on the loop and their messages are processed
+// before any message sent with Send, so they should not block. A command
+// returning a Batch or a Sequence has its commands dispatched as with Send,
+// without ordering guarantee.
+func WithInitialCommands(cmds ...Cmd) StmOptions {
+	return func(stm *Stm) {
+		stm.initialCmds = append(stm.initialCmds, cmds...)
+	}
+}
+
+// WithLogger sets a logger receiving every message processed by the state
+// machine.
+func WithLogger(logger Logger) StmOptions {
+	return func(stm *Stm) {
+		stm.logger = logger
+	}
+}
+
+// WithSynchronousDispatch makes Send execute the commands in the calling
+// goroutine instead of a new one, so their messages reach the loop in the
+// order they are sent and the commands of a Batch run in the listed order.
+// The commands returned by Update are executed by the loop itself, so a
+// blocking command stalls the state machine. This changes the concurrency
+// semantics and is intended for tests. The order is only guaranteed while
+// the buffer is not full. Commands running until the termination of the
+// machine, like Tick, still run in their own goroutine.
+func WithSynchronousDispatch() StmOptions {
+	return func(stm *Stm) {
+		stm.synchronous = true
+	}
+}
+
+// WithDeterministicScheduler executes the commands one at a time in a single
+// goroutine, picking the next one among the waiting commands with a random
+// generator seeded with seed rather than relying on the timing of goroutines.
+// For the same seed, the interleavings of the commands dispatched together,
+// like the commands of a Batch, are the same from one run to the next, which
+// makes the tests of concurrent commands reproducible. A blocking command
+// stalls all the others, and the commands running until the termination of
+// the machine, like Tick, still run in their own goroutine. It is meant for
+// tests and not for production use. WithSynchronousDispatch takes precedence,
+// and it takes precedence over WithPooling and WithMaxConcurrentCommands.
+func WithDeterministicScheduler(seed int64) StmOptions {
+	return func(stm *Stm) {
+		stm.random = rand.New(rand.NewSource(seed))
+		stm.wakeScheduler = make(chan struct{}, 1)
 	}
 }
@@ -4,12 +4,23 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/fdelbos/stm"
 	"github.com/fdelbos/stm/mocks"
+	"github.com/fdelbos/stm/stmtest"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/sync/singleflight"
 )
 
 type Suite struct {
@@ -25,6 +36,25 @@ func (s *Suite) randString() string {
 	return hex.EncodeToString(buff)
 }
 
+// results sends cmd to a new state machine and returns the messages given to
+// Update once the machine is idle.
+func (s *Suite) results(cmd Cmd) []Msg {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	msgs := []Msg{}
+	state := mocks.NewStmState(s.T())
+	state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+		msgs = append(msgs, msg)
+		return state, nil
+	}).Maybe()
+
+	machine := New(ctx, state)
+	machine.Send(cmd)
+	s.Require().NoError(machine.WaitIdle(ctx))
+	return msgs
+}
+
 func TestSuite(t *testing.T) {
 	suite.Run(t, &Suite{})
 }
@@ -74,25 +104,25 @@ func (s *Suite) TestStm() {
 		s.Equal(msg2, <-chNotif)
 	})
 
-	s.Run("should send a batch of messages", func() {
-		chNotif := make(chan interface{})
+	s.Run("should send a batch of messages in order", func() {
+		chNotif := make(chan Msg, 2)
 		msg1 := s.randString()
 		msg2 := s.randString()
 
 		state.On("Update", msg1).Return(func(received Msg) (State, Cmd) {
-			chNotif <- nil
+			chNotif <- received
 			return state, nil
 		})
 
 		state.On("Update", msg2).Return(func(received Msg) (State, Cmd) {
-			chNotif <- nil
+			chNotif <- received
 			return state, nil
 		})
 
-		machine.Send(Batch(ToCmd(msg2), ToCmd(msg1)))
+		New(ctx, state, WithSynchronousDispatch()).Send(Batch(ToCmd(msg2), ToCmd(msg1)))
 
-		<-chNotif
-		<-chNotif
+		s.Equal(msg2, <-chNotif)
+		s.Equal(msg1, <-chNotif)
 	})
 
 	s.Run("should send a message after some time", func() {
@@ -112,7 +142,7 @@ func (s *Suite) TestStm() {
 	})
 
 	s.Run("should transition to a new state", func() {
-		chNotif := make(chan interface{})
+		chNotif := make(chan Msg, 2)
 		msgInit := s.randString()
 		msgAfter := s.randString()
 
@@ -121,13 +151,13 @@ func (s *Suite) TestStm() {
 			return ToCmd(msgInit)
 		})
 
-		newState.On("Update", msgInit).Return(func(Msg) (State, Cmd) {
-			chNotif <- nil
+		newState.On("Update", msgInit).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
 			return newState, nil
 		})
 
-		newState.On("Update", msgAfter).Return(func(Msg) (State, Cmd) {
-			chNotif <- nil
+		newState.On("Update", msgAfter).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
 			return newState, nil
 		})
 
@@ -136,13 +166,11 @@ func (s *Suite) TestStm() {
 			return state, cmd
 		})
 
-		machine.Send(ToCmd("start"))
+		// with synchronous dispatch the init message is always first
+		New(ctx, state, WithSynchronousDispatch()).Send(ToCmd("start"))
 
-		// message can be sent in any order so lets wait a bit
-		timer := time.NewTimer(time.Millisecond * 100)
-		<-timer.C
-		<-chNotif
-		<-chNotif
+		s.Equal(msgInit, <-chNotif)
+		s.Equal(msgAfter, <-chNotif)
 	})
 
 	s.Run("should send a nil message", func() {
@@ -157,3 +185,5053 @@ func (s *Suite) TestStm() {
 	})
 
 }
+
+func (s *Suite) TestWaitIdle() {
+	s.Run("should return once all the messages are processed", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		processed := int32(0)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			atomic.AddInt32(&processed, 1)
+			return state, nil
+		}).Times(3)
+
+		machine := New(ctx, state)
+		machine.Send(Batch(
+			Timer(time.Millisecond*10, "a"),
+			Timer(time.Millisecond*20, "b"),
+			Timer(time.Millisecond*30, "c"),
+		))
+		s.NoError(machine.WaitIdle(ctx))
+		s.Equal(int32(3), atomic.LoadInt32(&processed))
+	})
+
+	s.Run("should return the error of the context", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		machine.Send(Timer(time.Hour, "never"))
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, time.Millisecond*20)
+		defer waitCancel()
+		s.ErrorIs(machine.WaitIdle(waitCtx), context.DeadlineExceeded)
+	})
+
+	s.Run("should return ErrTerminated when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		cancel()
+		<-machine.Done()
+		s.ErrorIs(machine.WaitIdle(s.ctx), ErrTerminated)
+	})
+}
+
+func (s *Suite) TestSubscribe() {
+	s.Run("should send the messages to every subscriber", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil)
+		machine := New(ctx, state, WithSynchronousDispatch())
+
+		first, unsubscribeFirst := machine.Subscribe()
+		defer unsubscribeFirst()
+		second, unsubscribeSecond := machine.Subscribe()
+
+		s.NoError(machine.SendSync(ToCmd("a")))
+		s.NoError(machine.SendSync(ToCmd("b")))
+		unsubscribeSecond()
+		s.NoError(machine.SendSync(ToCmd("c")))
+
+		s.Equal("a", <-first)
+		s.Equal("b", <-first)
+		s.Equal("c", <-first)
+
+		received := []Msg{}
+		for msg := range second {
+			received = append(received, msg)
+		}
+		s.Equal([]Msg{"a", "b"}, received)
+	})
+
+	s.Run("should drop the messages of a slow subscriber", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil)
+		machine := New(ctx, state, WithSynchronousDispatch())
+
+		ch, unsubscribe := machine.Subscribe()
+		defer unsubscribe()
+		for i := 0; i < DefaultMessageBufferSize+5; i++ {
+			s.NoError(machine.SendSync(ToCmd(i)))
+		}
+		s.Len(ch, DefaultMessageBufferSize)
+		s.Equal(0, <-ch)
+	})
+
+	s.Run("should close the channels on termination", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		ch, unsubscribe := machine.Subscribe()
+		cancel()
+		<-machine.Done()
+
+		_, ok := <-ch
+		s.False(ok)
+		unsubscribe()
+
+		ch, _ = machine.Subscribe()
+		_, ok = <-ch
+		s.False(ok)
+	})
+}
+
+func (s *Suite) TestOnceIdle() {
+	state := mocks.NewStmState(s.T())
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	machine := New(ctx, state)
+
+	s.Run("should send the message once all commands are done", func() {
+		chNotif := make(chan Msg, 3)
+		msgSlow := s.randString()
+		msgIdle := s.randString()
+
+		state.On("Update", msgSlow).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		state.On("Update", msgIdle).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine.Send(Timer(time.Millisecond*100, msgSlow))
+		machine.Send(OnceIdle(msgIdle))
+
+		s.Equal(msgSlow, <-chNotif)
+		s.Equal(msgIdle, <-chNotif)
+
+		timer := time.NewTimer(time.Millisecond * 100)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+}
+
+func (s *Suite) TestFromChannel() {
+	s.Run("should forward the values in order", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		ch := make(chan int)
+		read := FromChannel(ch, func(value int) Msg {
+			return value * 10
+		})
+
+		chNotif := make(chan Msg, 3)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, read
+		}).Times(3)
+
+		machine := New(ctx, state)
+		machine.Send(read)
+		go func() {
+			for i := 1; i <= 3; i++ {
+				ch <- i
+			}
+			close(ch)
+		}()
+
+		s.Equal(10, <-chNotif)
+		s.Equal(20, <-chNotif)
+		s.Equal(30, <-chNotif)
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		machine.Send(FromChannel(make(chan int), func(value int) Msg {
+			return value
+		}))
+		cancel()
+		<-machine.Done()
+	})
+}
+
+func (s *Suite) TestAwaitErr() {
+	onDone := func(err error) Msg {
+		return []interface{}{"done", err}
+	}
+
+	s.Run("should send the error of the operation", func() {
+		err := errors.New(s.randString())
+		ch := make(chan error, 1)
+		ch <- err
+		s.Equal([]Msg{[]interface{}{"done", err}}, s.results(AwaitErr(ch, onDone)))
+	})
+
+	s.Run("should send nil when the channel is closed", func() {
+		ch := make(chan error)
+		close(ch)
+		s.Equal([]Msg{[]interface{}{"done", nil}}, s.results(AwaitErr(ch, onDone)))
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		machine.Send(AwaitErr(make(chan error), onDone))
+		cancel()
+		<-machine.Done()
+	})
+}
+
+func (s *Suite) TestAwaitCond() {
+	s.Run("should send the message once the predicate holds", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "ready").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		c := sync.NewCond(&sync.Mutex{})
+		count := 0
+		machine := New(ctx, state)
+		machine.Send(AwaitCond(c, func() bool { return count >= 2 }, "ready"))
+
+		for i := 0; i < 2; i++ {
+			c.L.Lock()
+			count++
+			c.L.Unlock()
+			c.Broadcast()
+		}
+		s.Equal("ready", <-chNotif)
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+
+			c := sync.NewCond(&sync.Mutex{})
+			waiting := make(chan struct{})
+			var once sync.Once
+			machine := New(ctx, mocks.NewStmState(s.T()))
+			machine.Send(AwaitCond(c, func() bool {
+				once.Do(func() { close(waiting) })
+				return false
+			}, "ready"))
+			<-waiting
+			cancel()
+			<-machine.Done()
+		})
+	})
+}
+
+func (s *Suite) TestUntilDone() {
+	wrap := func(err error) Msg {
+		return []interface{}{"done", err}
+	}
+
+	s.Run("should send the error of the context", func() {
+		ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*10)
+		defer cancel()
+		s.Equal([]Msg{[]interface{}{"done", context.DeadlineExceeded}}, s.results(UntilDone(ctx, wrap)))
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+
+			machine := New(ctx, mocks.NewStmState(s.T()))
+			machine.Send(UntilDone(context.Background(), wrap))
+			cancel()
+			<-machine.Done()
+		})
+	})
+}
+
+func (s *Suite) TestWatchContext() {
+	s.Run("should send the error of the watched context", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		reqCtx, reqCancel := context.WithCancel(s.ctx)
+		machine := New(ctx, state)
+		machine.Send(WatchContext(reqCtx, func(err error) Msg {
+			return err
+		}))
+		reqCancel()
+		s.Equal(context.Canceled, <-chNotif)
+	})
+}
+
+// deadlinedMsg is a message carrying its deadline.
+type deadlinedMsg struct {
+	deadline time.Time
+}
+
+func (m deadlinedMsg) Deadline() time.Time {
+	return m.deadline
+}
+
+func (s *Suite) TestDeadlined() {
+	s.Run("should scope the commands with the deadline of the message", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		deadline := time.Now().Add(time.Millisecond * 50)
+		chDeadline := make(chan time.Time, 1)
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", deadlinedMsg{deadline: deadline}).Return(state, Batch(
+			ContextCmd(func(ctx context.Context) Msg {
+				d, _ := ctx.Deadline()
+				chDeadline <- d
+				return "in time"
+			}),
+			Timer(time.Hour, "late"),
+		)).Once()
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		machine := New(ctx, state)
+		machine.Send(ToCmd(deadlinedMsg{deadline: deadline}))
+
+		s.Equal(deadline, <-chDeadline)
+		s.Equal("in time", <-chNotif)
+
+		// the timer is stopped at the deadline
+		idleCtx, idleCancel := context.WithTimeout(ctx, time.Second)
+		defer idleCancel()
+		s.Require().NoError(machine.WaitIdle(idleCtx))
+		s.Empty(chNotif)
+	})
+}
+
+func (s *Suite) TestBarrier() {
+	progress := func(done, total int) Msg {
+		return []int{done, total}
+	}
+
+	s.Run("should send the progress then the final message", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 4)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(4)
+
+		cmd, barrier := Barrier(3, progress, "done")
+		machine := New(ctx, state)
+		machine.Send(cmd)
+		for i := 0; i < 4; i++ {
+			go barrier.Done()
+		}
+
+		s.Equal([]int{1, 3}, <-chNotif)
+		s.Equal([]int{2, 3}, <-chNotif)
+		s.Equal([]int{3, 3}, <-chNotif)
+		s.Equal("done", <-chNotif)
+	})
+
+	s.Run("should send the final message without items", func() {
+		cmd, _ := Barrier(0, progress, "done")
+		s.Equal([]Msg{"done"}, s.results(cmd))
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+
+			cmd, barrier := Barrier(2, nil, "done")
+			machine := New(ctx, mocks.NewStmState(s.T()))
+			machine.Send(cmd)
+			cancel()
+			<-machine.Done()
+
+			barrier.Done()
+			barrier.Done()
+			barrier.Done()
+		})
+	})
+}
+
+func (s *Suite) TestDrainChannel() {
+	s.Run("should drain all the available values", func() {
+		ch := make(chan int, 3)
+		ch <- 1
+		ch <- 2
+		ch <- 3
+
+		msg := DrainChannel(ch, func(values []int) Msg {
+			return values
+		})()
+		s.Equal([]int{1, 2, 3}, msg)
+		s.Empty(ch)
+	})
+
+	s.Run("should let wrap decide what to send when empty", func() {
+		ch := make(chan int)
+		wrap := func(values []int) Msg {
+			if len(values) == 0 {
+				return nil
+			}
+			return values
+		}
+		s.Nil(DrainChannel(ch, wrap)())
+
+		close(ch)
+		s.Nil(DrainChannel(ch, wrap)())
+	})
+}
+
+func (s *Suite) TestShutdownCommand() {
+	s.Run("should run the shutdown command when the context is done", func() {
+		state := mocks.NewStmState(s.T())
+		chNotif := make(chan Msg, 1)
+		msg := s.randString()
+
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		New(ctx, state, WithShutdownCommand(ToCmd(msg), time.Second))
+		cancel()
+
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should run the shutdown commands sending messages over time", func() {
+		state := mocks.NewStmState(s.T())
+		chNotif := make(chan Msg, 1)
+		state.On("Update", "context").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, state, WithShutdownCommand(ContextCmd(func(ctx context.Context) Msg {
+			if ctx.Err() != nil {
+				return "canceled"
+			}
+			return "context"
+		}), time.Second))
+		cancel()
+
+		<-machine.Done()
+		s.Equal("context", <-chNotif)
+	})
+
+	s.Run("should give up after the timeout", func() {
+		state := mocks.NewStmState(s.T())
+		chDone := make(chan interface{})
+
+		defer close(chDone)
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, state, WithShutdownCommand(func() Msg {
+			<-chDone
+			return nil
+		}, time.Millisecond*50))
+		start := time.Now()
+		cancel()
+
+		select {
+		case <-machine.Done():
+			s.GreaterOrEqual(time.Since(start), time.Millisecond*50)
+			s.Less(time.Since(start), time.Millisecond*150)
+		case <-time.After(time.Second):
+			s.Fail("the machine is not terminated")
+		}
+	})
+
+	s.Run("should run the shutdown command as the other commands", func() {
+		state := mocks.NewStmState(s.T())
+		chNotif := make(chan Msg, 1)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		wrapped := false
+		middleware := func(cmd Cmd) Cmd {
+			return func() Msg {
+				wrapped = true
+				return cmd()
+			}
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		New(ctx, state, WithPanicRecovery(), WithCommandMiddleware(middleware), WithShutdownCommand(func() Msg {
+			panic("shutdown")
+		}, time.Second))
+		cancel()
+
+		_, ok := (<-chNotif).(CmdPanic)
+		s.True(ok)
+		s.True(wrapped)
+	})
+}
+
+func (s *Suite) TestNewChild() {
+	s.Run("should forward messages between parent and child", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		parentState := mocks.NewStmState(s.T())
+		parent := New(ctx, parentState)
+
+		childState := mocks.NewStmState(s.T())
+		childState.On("Update", "ping").Return(childState, Forward(parent, "pong")).Once()
+		child := NewChild(parent, childState)
+
+		parentState.On("Update", "start").Return(parentState, Forward(child, "ping")).Once()
+		parentState.On("Update", "pong").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return parentState, nil
+		}).Once()
+
+		parent.Send(ToCmd("start"))
+		s.Equal("pong", <-chNotif)
+	})
+
+	s.Run("should terminate the child with the parent", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		parent := New(ctx, mocks.NewStmState(s.T()))
+		child := NewChild(parent, mocks.NewStmState(s.T()))
+		parent.Send(Quit())
+
+		<-child.Done()
+		s.ErrorIs(child.Err(), ErrQuit)
+	})
+
+	s.Run("should not terminate the parent with the child", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		parent := New(ctx, mocks.NewStmState(s.T()))
+		child := NewChild(parent, mocks.NewStmState(s.T()))
+		child.Send(Quit())
+
+		<-child.Done()
+		s.NoError(parent.Err())
+	})
+}
+
+func (s *Suite) TestMerge() {
+	s.Run("should send the messages of the children to the parent", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		parent := New(ctx, namedState{name: "parent", chNotif: chNotif})
+
+		newChild := func(name string) *Stm {
+			state := mocks.NewStmState(s.T())
+			state.On("Update", "emit").Return(state, Emit(name)).Maybe()
+			return NewChild(parent, state)
+		}
+		first, second := newChild("first"), newChild("second")
+		stop := Merge(parent, first, second)
+
+		s.NoError(first.SendSync(ToCmd("emit")))
+		s.NoError(second.SendSync(ToCmd("emit")))
+		s.ElementsMatch([]Msg{"first", "second"}, []Msg{<-chNotif, <-chNotif})
+
+		stop()
+		s.NoError(first.SendSync(ToCmd("emit")))
+		s.NoError(first.WaitIdle(ctx))
+		s.NoError(parent.WaitIdle(ctx))
+		s.Empty(chNotif)
+	})
+
+	s.Run("should send the messages in batches", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		parent := New(ctx, namedState{name: "parent", chNotif: chNotif})
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			return state, Emit(msg)
+		})
+		clock := stmtest.NewFakeClock(time.Now())
+		childCtx, childCancel := context.WithCancel(ctx)
+		child := New(childCtx, state, WithClock(clock), WithEmitBatch(3, time.Second))
+		Merge(parent, child)
+
+		// flushed by size
+		for _, msg := range []string{"a", "b", "c"} {
+			s.NoError(child.SendSync(ToCmd(msg)))
+		}
+		s.NoError(child.WaitIdle(ctx))
+		s.ElementsMatch(EmitBatch{"a", "b", "c"}, <-chNotif)
+
+		// flushed by time
+		s.NoError(child.SendSync(ToCmd("d")))
+		s.NoError(child.WaitIdle(ctx))
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		s.Equal(EmitBatch{"d"}, <-chNotif)
+
+		// flushed on termination
+		s.NoError(child.SendSync(ToCmd("e")))
+		s.NoError(child.WaitIdle(ctx))
+		childCancel()
+		<-child.Done()
+		s.Equal(EmitBatch{"e"}, <-chNotif)
+	})
+}
+
+func (s *Suite) TestBroadcast() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.Run("should send the message to every sender", func() {
+		chNotif := make(chan Msg, 2)
+		msg := s.randString()
+		calls := 0
+
+		senders := []Sender{}
+		for i := 0; i < 2; i++ {
+			state := mocks.NewStmState(s.T())
+			state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+				chNotif <- msg
+				return state, nil
+			}).Once()
+			senders = append(senders, New(ctx, state))
+		}
+
+		emitter := New(ctx, mocks.NewStmState(s.T()))
+		emitter.Send(Broadcast(senders, func() Msg {
+			calls++
+			return msg
+		}))
+
+		s.Equal(msg, <-chNotif)
+		s.Equal(msg, <-chNotif)
+		s.Equal(1, calls)
+	})
+
+	s.Run("should execute the commands sending messages over time once", func() {
+		chNotif := make(chan Msg, 2)
+		msg := s.randString()
+		calls := int32(0)
+
+		senders := []Sender{}
+		for i := 0; i < 2; i++ {
+			state := mocks.NewStmState(s.T())
+			state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+				chNotif <- msg
+				return state, nil
+			}).Once()
+			senders = append(senders, New(ctx, state))
+		}
+
+		emitter := New(ctx, mocks.NewStmState(s.T()))
+		emitter.Send(Broadcast(senders, ContextCmd(func(context.Context) Msg {
+			atomic.AddInt32(&calls, 1)
+			return msg
+		})))
+
+		s.Equal(msg, <-chNotif)
+		s.Equal(msg, <-chNotif)
+		s.Equal(int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func (s *Suite) TestBroadcastCollect() {
+	s.Run("should send the outcome of each delivery", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		msg := s.randString()
+		chNotif := make(chan Msg, 1)
+		live := New(ctx, namedState{name: "live", chNotif: chNotif})
+
+		deadCtx, deadCancel := context.WithCancel(s.ctx)
+		dead := New(deadCtx, mocks.NewStmState(s.T()))
+		deadCancel()
+		<-dead.Done()
+
+		outcomes := s.results(BroadcastCollect(
+			[]NamedSender{{Name: "live", To: live}, {Name: "dead", To: dead}},
+			ToCmd(msg),
+			func(outcomes map[string]error) Msg {
+				return outcomes
+			}))
+
+		s.Equal(msg, <-chNotif)
+		s.Require().Len(outcomes, 1)
+		s.Equal(map[string]error{"live": nil, "dead": ErrTerminated}, outcomes[0])
+	})
+
+	s.Run("should report the full buffers", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chGate := make(chan interface{})
+		defer close(chGate)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		full := New(ctx, state, WithMessageBufferSize(1))
+		// the loop blocks on the first message and the second fills the
+		// buffer
+		s.True(<-full.TrySend(ToCmd("first")))
+		s.Eventually(func() bool {
+			return full.QueueLen() == 0
+		}, time.Second, time.Millisecond)
+		s.True(<-full.TrySend(ToCmd("second")))
+
+		outcomes := s.results(BroadcastCollect(
+			[]NamedSender{{Name: "full", To: full}},
+			ToCmd(s.randString()),
+			func(outcomes map[string]error) Msg {
+				return outcomes
+			}))
+		s.Equal([]Msg{map[string]error{"full": ErrDropped}}, outcomes)
+	})
+}
+
+func (s *Suite) TestWaitForAny() {
+	named := func(name string) func(State) bool {
+		return func(state State) bool {
+			return state.(namedState).name == name
+		}
+	}
+	index := func(i int) Msg {
+		return i
+	}
+
+	s.Run("should send the index of the first condition satisfied", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		x := New(ctx, namedState{name: "x1", chNotif: chNotif})
+		y := New(ctx, namedState{name: "y1", chNotif: chNotif})
+
+		received := make(chan Msg, 1)
+		waiter := mocks.NewStmState(s.T())
+		waiter.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			received <- msg
+			return waiter, nil
+		}).Once()
+
+		machine := New(ctx, waiter)
+		machine.Send(WaitForAny([]StateCondition{
+			{Machine: x, Match: named("x2")},
+			{Machine: y, Match: named("y2")},
+		}, index))
+
+		s.NoError(x.SendSync(ToCmd("stay")))
+		s.NoError(y.SendSync(ToCmd(namedState{name: "y2", chNotif: chNotif})))
+		s.Equal(1, <-received)
+
+		// the other condition is no longer watched
+		s.NoError(x.SendSync(ToCmd(namedState{name: "x2", chNotif: chNotif})))
+		s.NoError(machine.WaitIdle(ctx))
+		s.Empty(received)
+	})
+
+	s.Run("should send a condition already satisfied", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		x := New(ctx, namedState{name: "x1", chNotif: make(chan Msg)})
+		s.Equal([]Msg{0}, s.results(WaitForAny([]StateCondition{
+			{Machine: x, Match: named("x1")},
+		}, index)))
+	})
+
+	s.Run("should stop when the watched machines are terminated", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+			x := New(ctx, namedState{name: "x1", chNotif: make(chan Msg)})
+			cancel()
+			<-x.Done()
+
+			s.Empty(s.results(WaitForAny([]StateCondition{
+				{Machine: x, Match: named("x2")},
+			}, index)))
+		})
+	})
+}
+
+func (s *Suite) TestMaxLifetime() {
+	s.Run("should terminate the state machine after its lifetime", func() {
+		machine := New(s.ctx, mocks.NewStmState(s.T()), WithMaxLifetime(time.Millisecond*50))
+		s.Nil(machine.Err())
+
+		s.Eventually(func() bool {
+			return errors.Is(machine.Err(), ErrLifetimeExceeded)
+		}, time.Second, time.Millisecond*10)
+	})
+
+	s.Run("should be terminated by the context first", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, mocks.NewStmState(s.T()), WithMaxLifetime(time.Millisecond*50))
+		cancel()
+
+		s.ErrorIs(machine.Err(), context.Canceled)
+		timer := time.NewTimer(time.Millisecond * 100)
+		<-timer.C
+		s.ErrorIs(machine.Err(), context.Canceled)
+	})
+}
+
+func (s *Suite) TestSingleFlight() {
+	s.Run("should execute concurrent commands once", func() {
+		group := &singleflight.Group{}
+		key := s.randString()
+		msg := s.randString()
+		chStart := make(chan interface{})
+		calls := int32(0)
+
+		fn := func() (Msg, error) {
+			atomic.AddInt32(&calls, 1)
+			<-chStart
+			return msg, nil
+		}
+
+		results := make(chan Msg, 2)
+		go func() { results <- SingleFlight(group, key, fn)() }()
+		s.Eventually(func() bool {
+			return atomic.LoadInt32(&calls) == 1
+		}, time.Second, time.Millisecond)
+		go func() { results <- SingleFlight(group, key, fn)() }()
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		close(chStart)
+
+		s.Equal(msg, <-results)
+		s.Equal(msg, <-results)
+		s.Equal(int32(1), atomic.LoadInt32(&calls))
+	})
+
+	s.Run("should send an error message on failure", func() {
+		err := errors.New(s.randString())
+		msg := SingleFlight(&singleflight.Group{}, s.randString(), func() (Msg, error) {
+			return nil, err
+		})()
+		s.Equal(ErrMsg{Err: err}, msg)
+	})
+}
+
+func (s *Suite) TestPerform() {
+	s.Run("should send the message on success", func() {
+		msg := s.randString()
+		s.Equal(msg, Perform(func() (Msg, error) {
+			return msg, nil
+		})())
+	})
+
+	s.Run("should send an error message on failure", func() {
+		err := errors.New(s.randString())
+		msg := Perform(func() (Msg, error) {
+			return s.randString(), err
+		})()
+		s.Equal(ErrMsg{Err: err}, msg)
+		s.Equal(ErrMsg{Err: err}, ErrorCmd(err)())
+	})
+}
+
+func (s *Suite) TestExpect() {
+	s.Run("should send the message when the type matches", func() {
+		msg := s.randString()
+		s.Equal(msg, Expect[string](ToCmd(msg))())
+		s.Nil(Expect[string](ToCmd(nil))())
+	})
+
+	s.Run("should send an error when the type doesn't match", func() {
+		msg := Expect[int](ToCmd(s.randString()))()
+		errMsg, ok := msg.(ErrMsg)
+		s.Require().True(ok)
+		s.ErrorIs(errMsg, ErrUnexpectedMsg)
+	})
+
+	s.Run("should check the messages sent over time", func() {
+		retry := Retry(ToCmd("ok"), 1, nil, nil)
+		s.Equal([]Msg{"ok"}, s.results(Expect[string](retry)))
+	})
+}
+
+func (s *Suite) TestTransitionTo() {
+	s.Run("should call Init from the loop before the next message", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		calls := []string{}
+		machine := New(ctx, initState{calls: &calls})
+		for i := 0; i < 3; i++ {
+			machine.Send(ToCmd("msg"))
+		}
+		s.Require().NoError(machine.WaitIdle(ctx))
+		s.Equal([]string{"update", "init", "update", "init", "update", "init"}, calls)
+	})
+}
+
+func (s *Suite) TestTransitionIf() {
+	for _, cond := range []bool{true, false} {
+		s.Run(fmt.Sprintf("should only initialize the chosen state when %v", cond), func() {
+			msg := s.randString()
+			chosen := mocks.NewStmState(s.T())
+			chosen.On("Init").Return(ToCmd(msg)).Once()
+			other := mocks.NewStmState(s.T())
+
+			yes, no := chosen, other
+			if !cond {
+				yes, no = other, chosen
+			}
+
+			next, cmd := TransitionIf(cond, yes, no)
+			s.Equal(chosen, next)
+			s.Equal([]Msg{msg}, s.results(cmd))
+			other.AssertNotCalled(s.T(), "Init")
+		})
+	}
+}
+
+func (s *Suite) TestInitWithSender() {
+	s.Run("should process the commands sent by the new state", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		next := senderState{
+			namedState: namedState{name: "next", chNotif: make(chan Msg, 3)},
+			msgs:       []Msg{"first", "second"},
+			init:       "init",
+		}
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "start").Return(func(Msg) (State, Cmd) {
+			return TransitionTo(next)
+		}).Once()
+
+		New(ctx, state).Send(ToCmd("start"))
+
+		received := []Msg{}
+		for i := 0; i < 3; i++ {
+			received = append(received, <-next.chNotif)
+		}
+		s.ElementsMatch([]Msg{"first", "second", "init"}, received)
+	})
+}
+
+func (s *Suite) TestTransitionToWithTimeout() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	// transition sends a transition to a new state and returns the first
+	// message received by the new state.
+	transition := func(init Cmd, onTimeout Msg) Msg {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		newState := mocks.NewStmState(s.T())
+		newState.On("Init").Return(init)
+		newState.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return newState, nil
+		}).Once()
+
+		state.On("Update", "start").Return(func(Msg) (State, Cmd) {
+			return TransitionToWithTimeout(newState, time.Millisecond*50, onTimeout)
+		})
+
+		New(ctx, state).Send(ToCmd("start"))
+		return <-chNotif
+	}
+
+	s.Run("should send the init message when it is fast enough", func() {
+		msgInit := s.randString()
+		s.Equal(msgInit, transition(ToCmd(msgInit), s.randString()))
+	})
+
+	s.Run("should send the timeout message when init is too slow", func() {
+		msgTimeout := s.randString()
+		s.Equal(msgTimeout, transition(Timer(time.Millisecond*200, s.randString()), msgTimeout))
+
+		timer := time.NewTimer(time.Millisecond * 250)
+		<-timer.C
+	})
+
+	s.Run("should initialize a state using the sender", func() {
+		next := senderState{
+			namedState: namedState{name: "next", chNotif: make(chan Msg, 2)},
+			msgs:       []Msg{"first"},
+			init:       "init",
+		}
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "start").Return(func(Msg) (State, Cmd) {
+			return TransitionToWithTimeout(next, time.Millisecond*50, s.randString())
+		}).Once()
+
+		New(ctx, state).Send(ToCmd("start"))
+
+		received := []Msg{<-next.chNotif, <-next.chNotif}
+		s.ElementsMatch([]Msg{"first", "init"}, received)
+	})
+}
+
+func (s *Suite) TestSample() {
+	s.Run("should send one message every n calls", func() {
+		msg := s.randString()
+		cmd := Sample(3, ToCmd(msg))
+
+		for i := 0; i < 2; i++ {
+			s.Nil(cmd())
+			s.Nil(cmd())
+			s.Equal(msg, cmd())
+		}
+	})
+
+	s.Run("should send every message when n <= 1", func() {
+		msg := s.randString()
+		cmd := Sample(0, ToCmd(msg))
+		s.Equal(msg, cmd())
+		s.Equal(msg, cmd())
+	})
+}
+
+func (s *Suite) TestTimed() {
+	wrap := func(msg Msg, d time.Duration) Msg {
+		return []interface{}{msg, d}
+	}
+
+	s.Run("should wrap the message with the duration", func() {
+		duration := time.Millisecond * 50
+		msg := s.randString()
+
+		results := s.results(Timed(Timer(duration, msg), wrap))
+		s.Require().Len(results, 1)
+		result := results[0].([]interface{})
+		s.Equal(msg, result[0])
+		s.GreaterOrEqual(result[1], duration)
+	})
+
+	s.Run("should not wrap a nil message", func() {
+		s.Empty(s.results(Timed(ToCmd(nil), wrap)))
+	})
+
+	s.Run("should wait for the messages sent over time", func() {
+		duration := time.Millisecond * 50
+		msg := s.randString()
+
+		results := s.results(Timed(TimerAt(time.Now().Add(duration), msg), wrap))
+		s.Require().Len(results, 1)
+		result := results[0].([]interface{})
+		s.Equal(msg, result[0])
+		s.GreaterOrEqual(result[1], duration-time.Millisecond*5)
+	})
+}
+
+func (s *Suite) TestSendAll() {
+	s.Run("should send every command", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(3)
+
+		machine := New(ctx, state)
+		machine.SendAll(ToCmd("a"), nil, ToCmd("b"), ToCmd("c"))
+		s.ElementsMatch([]Msg{"a", "b", "c"}, []Msg{<-chNotif, <-chNotif, <-chNotif})
+	})
+}
+
+func (s *Suite) TestSendCtx() {
+	s.Run("should send the message of the command", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Twice()
+
+		machine := New(ctx, state)
+		machine.SendCtx(func(context.Context) Msg {
+			return "a"
+		})
+		s.Equal("a", <-chNotif)
+
+		machine.Send(ContextCmd(func(context.Context) Msg {
+			return "b"
+		}))
+		s.Equal("b", <-chNotif)
+	})
+
+	s.Run("should cancel the command on termination", func() {
+		for _, send := range []func(*Stm, CmdCtx){
+			(*Stm).SendCtx,
+			func(machine *Stm, cmd CmdCtx) { machine.Send(ContextCmd(cmd)) },
+		} {
+			ctx, cancel := context.WithCancel(s.ctx)
+			state := mocks.NewStmState(s.T())
+			machine := New(ctx, state)
+
+			started := make(chan struct{})
+			observed := make(chan struct{})
+			send(machine, func(ctx context.Context) Msg {
+				close(started)
+				<-ctx.Done()
+				close(observed)
+				return s.randString()
+			})
+
+			<-started
+			cancel()
+			<-observed
+			<-machine.Done()
+		}
+	})
+}
+
+type ctxKey struct{}
+
+func (s *Suite) TestContextValues() {
+	s.Run("should give the values of the context to the commands", func() {
+		value := s.randString()
+		ctx, cancel := context.WithCancel(context.WithValue(s.ctx, ctxKey{}, value))
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(3)
+
+		machine := New(ctx, state)
+		s.Equal(value, ContextFromStm(machine).Value(ctxKey{}))
+
+		read := func(ctx context.Context) Msg {
+			return ctx.Value(ctxKey{})
+		}
+		machine.SendCtx(read)
+		s.Equal(value, <-chNotif)
+		machine.Send(ContextCmd(read))
+		s.Equal(value, <-chNotif)
+		machine.SendNamed("read", read)
+		s.Equal(value, <-chNotif)
+	})
+}
+
+func (s *Suite) TestSendNamed() {
+	state := mocks.NewStmState(s.T())
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	machine := New(ctx, state)
+
+	s.Run("should send the message of a named command", func() {
+		chNotif := make(chan Msg, 1)
+		msg := s.randString()
+
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine.SendNamed(s.randString(), func(context.Context) Msg {
+			return msg
+		})
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should cancel a named command", func() {
+		chStarted := make(chan interface{})
+		chCancelled := make(chan interface{})
+		name := s.randString()
+
+		machine.SendNamed(name, func(ctx context.Context) Msg {
+			close(chStarted)
+			<-ctx.Done()
+			close(chCancelled)
+			return s.randString()
+		})
+
+		<-chStarted
+		machine.CancelNamed(name)
+		<-chCancelled
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+	})
+
+	s.Run("should ignore an unknown name", func() {
+		machine.CancelNamed(s.randString())
+	})
+}
+
+func (s *Suite) TestOnConflict() {
+	errConflict := errors.New("conflict")
+	isConflict := func(err error) bool {
+		return errors.Is(err, errConflict)
+	}
+
+	s.Run("should retry on conflicts", func() {
+		msg := s.randString()
+		calls := 0
+		result := s.results(OnConflict(func(context.Context) (Msg, error) {
+			calls++
+			if calls < 3 {
+				return nil, errConflict
+			}
+			return msg, nil
+		}, isConflict, 2))
+
+		s.Equal([]Msg{msg}, result)
+		s.Equal(3, calls)
+	})
+
+	s.Run("should fail after too many conflicts", func() {
+		calls := 0
+		result := s.results(OnConflict(func(context.Context) (Msg, error) {
+			calls++
+			return nil, errConflict
+		}, isConflict, 2))
+
+		s.Require().Len(result, 1)
+		errMsg, ok := result[0].(ErrMsg)
+		s.Require().True(ok)
+		s.ErrorIs(errMsg, ErrTooManyConflicts)
+		s.ErrorIs(errMsg, errConflict)
+		s.Equal(3, calls)
+	})
+
+	s.Run("should fail immediately on other errors", func() {
+		err := errors.New(s.randString())
+		calls := 0
+		result := s.results(OnConflict(func(context.Context) (Msg, error) {
+			calls++
+			return nil, err
+		}, isConflict, 2))
+
+		s.Equal([]Msg{ErrMsg{Err: err}}, result)
+		s.Equal(1, calls)
+	})
+
+	s.Run("should stop retrying when terminated", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state)
+
+		var calls int32
+		machine.Send(OnConflict(func(ctx context.Context) (Msg, error) {
+			if atomic.AddInt32(&calls, 1) == 2 {
+				cancel()
+			}
+			return nil, errConflict
+		}, isConflict, 10))
+
+		<-machine.Done()
+		s.Equal(int32(2), atomic.LoadInt32(&calls))
+	})
+}
+
+func (s *Suite) TestBatchProcessing() {
+	s.Run("should process all the messages", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithBatchProcessing(3))
+
+		chNotif := make(chan Msg, 5)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(5)
+
+		for i := 0; i < 5; i++ {
+			machine.Send(ToCmd(i))
+		}
+
+		received := []Msg{}
+		for i := 0; i < 5; i++ {
+			received = append(received, <-chNotif)
+		}
+		s.ElementsMatch([]Msg{0, 1, 2, 3, 4}, received)
+	})
+}
+
+type timedState struct {
+	*mocks.StmState
+	timeout time.Duration
+	msg     Msg
+}
+
+func (t *timedState) Timeout() (time.Duration, Msg) {
+	return t.timeout, t.msg
+}
+
+func (s *Suite) TestTimedState() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.Run("should send the timeout message after inactivity", func() {
+		chNotif := make(chan Msg, 3)
+		msg := s.randString()
+		msgTimeout := s.randString()
+		state := &timedState{
+			StmState: mocks.NewStmState(s.T()),
+			timeout:  time.Millisecond * 100,
+			msg:      msgTimeout,
+		}
+		next := mocks.NewStmState(s.T())
+
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+		state.On("Update", msgTimeout).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return next, nil
+		})
+
+		start := time.Now()
+		machine := New(ctx, state)
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		machine.Send(ToCmd(msg))
+
+		s.Equal(msg, <-chNotif)
+		s.Equal(msgTimeout, <-chNotif)
+		s.True(time.Since(start) > time.Millisecond*150)
+
+		// the next state is not timed so nothing else is received
+		timer = time.NewTimer(time.Millisecond * 150)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+}
+
+func (s *Suite) TestWithCounter() {
+	s.Run("should count the messages", func() {
+		count := 0
+		inc := func() { count++ }
+		msg := s.randString()
+
+		s.Equal(msg, WithCounter(ToCmd(msg), inc)())
+		s.Equal(1, count)
+
+		s.Nil(WithCounter(ToCmd(nil), inc)())
+		s.Equal(1, count)
+	})
+}
+
+func (s *Suite) TestPooling() {
+	s.Run("should process the messages with pooling", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithPooling())
+
+		chNotif := make(chan Msg, 10)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(20)
+
+		for round := 0; round < 2; round++ {
+			machine.Send(Batch(
+				ToCmd(1), ToCmd(2), ToCmd(3), ToCmd(4), ToCmd(5),
+				ToCmd(6), ToCmd(7), ToCmd(8), ToCmd(9), ToCmd(10),
+			))
+			received := []Msg{}
+			for i := 0; i < 10; i++ {
+				received = append(received, <-chNotif)
+			}
+			s.ElementsMatch([]Msg{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, received)
+		}
+	})
+
+	s.Run("should allocate less than without pooling", func() {
+		allocs := func(opts ...StmOptions) float64 {
+			ctx, cancel := context.WithCancel(s.ctx)
+			defer cancel()
+			state := make(benchState, 1)
+			machine := New(ctx, state, opts...)
+			cmd := ToCmd(struct{}{})
+
+			return testing.AllocsPerRun(100, func() {
+				machine.Send(cmd)
+				<-state
+			})
+		}
+
+		s.Less(allocs(WithPooling()), allocs())
+	})
+
+	s.Run("should not leak workers after termination", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			state := mocks.NewStmState(s.T())
+			chNotif := make(chan Msg, 1)
+			msg := s.randString()
+			state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+				chNotif <- msg
+				return state, nil
+			})
+
+			ctx, cancel := context.WithCancel(s.ctx)
+			machine := New(ctx, state, WithPooling())
+			machine.Send(ToCmd(msg))
+			<-chNotif
+			cancel()
+		})
+	})
+}
+
+// benchState is a state forwarding every message to a channel.
+type benchState chan Msg
+
+func (b benchState) Init() Cmd {
+	return nil
+}
+
+func (b benchState) Update(msg Msg) (State, Cmd) {
+	b <- msg
+	return b, nil
+}
+
+func benchmarkSend(b *testing.B, opts ...StmOptions) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state := make(benchState, 100)
+	machine := New(ctx, state, opts...)
+	cmd := ToCmd(struct{}{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machine.Send(cmd)
+		<-state
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	benchmarkSend(b)
+}
+
+func BenchmarkSendWithPooling(b *testing.B) {
+	benchmarkSend(b, WithPooling())
+}
+
+func (s *Suite) TestMaxConcurrentCommands() {
+	s.Run("should run at most n commands at the same time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(10)
+
+		running := int32(0)
+		maxRunning := int32(0)
+		cmd := func(msg Msg) Cmd {
+			return func() Msg {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				timer := time.NewTimer(time.Millisecond * 10)
+				<-timer.C
+				return msg
+			}
+		}
+
+		machine := New(ctx, state, WithMaxConcurrentCommands(3))
+		cmds := []Cmd{}
+		for i := 0; i < 10; i++ {
+			cmds = append(cmds, cmd(i))
+		}
+		// the commands of the batch are queued in the pool
+		machine.Send(Batch(cmds...))
+
+		received := []Msg{}
+		for i := 0; i < 10; i++ {
+			received = append(received, <-chNotif)
+		}
+		s.ElementsMatch([]Msg{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, received)
+		s.Equal(int32(3), atomic.LoadInt32(&maxRunning))
+	})
+}
+
+// benchmarkGoroutines sends bursts of slow commands and reports the highest
+// number of goroutines observed.
+func benchmarkGoroutines(b *testing.B, opts ...StmOptions) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state := make(benchState, 100)
+	machine := New(ctx, state, opts...)
+	cmd := func() Msg {
+		timer := time.NewTimer(time.Millisecond)
+		<-timer.C
+		return struct{}{}
+	}
+
+	peak := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 100; j++ {
+			machine.Send(cmd)
+		}
+		if n := runtime.NumGoroutine(); n > peak {
+			peak = n
+		}
+		for j := 0; j < 100; j++ {
+			<-state
+		}
+	}
+	b.ReportMetric(float64(peak), "goroutines")
+}
+
+func BenchmarkGoroutines(b *testing.B) {
+	benchmarkGoroutines(b)
+}
+
+func BenchmarkGoroutinesWithMaxConcurrentCommands(b *testing.B) {
+	benchmarkGoroutines(b, WithMaxConcurrentCommands(8))
+}
+
+func (s *Suite) TestFromEnv() {
+	key := "STM_TEST_" + s.randString()
+	missing := "STM_TEST_" + s.randString()
+	value := s.randString()
+	s.T().Setenv(key, value)
+
+	s.Run("should build the message from the environment", func() {
+		msg := FromEnv([]string{key, missing}, func(env map[string]string) (Msg, error) {
+			return env, nil
+		})()
+		s.Equal(map[string]string{key: value}, msg)
+	})
+
+	s.Run("should send an error when build fails", func() {
+		err := errors.New(s.randString())
+		msg := FromEnv([]string{key}, func(map[string]string) (Msg, error) {
+			return nil, err
+		})()
+		s.Equal(ErrMsg{Err: err}, msg)
+	})
+}
+
+func (s *Suite) TestQuorum() {
+	equal := func(a, b Msg) bool {
+		return a == b
+	}
+
+	s.Run("should send the message of the majority", func() {
+		msg := s.randString()
+		results := s.results(Quorum(2, equal,
+			ToCmd(s.randString()),
+			Timer(time.Millisecond*10, msg),
+			ToCmd(nil),
+			Timer(time.Millisecond*20, msg),
+		))
+		s.Equal([]Msg{msg}, results)
+	})
+
+	s.Run("should send an error when there is no quorum", func() {
+		results := s.results(Quorum(2, equal,
+			ToCmd(s.randString()),
+			ToCmd(s.randString()),
+			ToCmd(nil),
+		))
+		s.Equal([]Msg{ErrMsg{Err: ErrNoQuorum}}, results)
+	})
+
+	s.Run("should count the first message of a retried command", func() {
+		msg := s.randString()
+		retry := Retry(ToCmd(msg), 3, func(int) time.Duration { return 0 }, func(Msg) bool { return false })
+		results := s.results(Quorum(2, equal, retry, ToCmd(msg)))
+		s.Equal([]Msg{msg}, results)
+	})
+}
+
+func (s *Suite) TestDebounce() {
+	s.Run("should only send the last message of a key", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 4)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		machine := New(ctx, state)
+		for _, msg := range []string{"a", "b", "c"} {
+			machine.SendSync(Debounce("key", time.Millisecond*30, msg))
+		}
+		machine.SendSync(Debounce("other", time.Millisecond*30, "d"))
+
+		s.ElementsMatch([]Msg{"c", "d"}, []Msg{<-chNotif, <-chNotif})
+		select {
+		case msg := <-chNotif:
+			s.Failf("unexpected message", "%v", msg)
+		case <-time.After(time.Millisecond * 60):
+		}
+	})
+
+	s.Run("should discard the pending messages on termination", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		machine.SendSync(Debounce("key", time.Millisecond*30, "a"))
+		cancel()
+		<-machine.Done()
+	})
+}
+
+func (s *Suite) TestRetry() {
+	failing := func(failures int32, calls *int32) Cmd {
+		return func() Msg {
+			if atomic.AddInt32(calls, 1) <= failures {
+				return ErrMsg{Err: errors.New("failed")}
+			}
+			return "success"
+		}
+	}
+	shouldRetry := func(msg Msg) bool {
+		_, failed := msg.(ErrMsg)
+		return failed
+	}
+	attempts := []int{}
+	backoff := func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return time.Millisecond * 10
+	}
+
+	newMachine := func(ctx context.Context) (*Stm, chan Msg) {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+		return New(ctx, state), chNotif
+	}
+
+	s.Run("should retry until the command succeeds", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		attempts = nil
+
+		calls := int32(0)
+		machine, chNotif := newMachine(ctx)
+		machine.Send(Retry(failing(2, &calls), 5, backoff, shouldRetry))
+
+		s.Equal("success", <-chNotif)
+		s.Equal(int32(3), atomic.LoadInt32(&calls))
+		s.Equal([]int{1, 2}, attempts)
+	})
+
+	s.Run("should send the last message when out of attempts", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		calls := int32(0)
+		machine, chNotif := newMachine(ctx)
+		machine.Send(Retry(failing(5, &calls), 2, backoff, shouldRetry))
+
+		s.True(shouldRetry(<-chNotif))
+		s.Equal(int32(2), atomic.LoadInt32(&calls))
+	})
+
+	s.Run("should run the command once when attempts <= 0", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		calls := int32(0)
+		machine, chNotif := newMachine(ctx)
+		machine.Send(Retry(failing(5, &calls), 0, backoff, shouldRetry))
+
+		s.True(shouldRetry(<-chNotif))
+		s.Equal(int32(1), atomic.LoadInt32(&calls))
+	})
+
+	s.Run("should stop waiting when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		calls := int32(0)
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		machine.Send(Retry(failing(5, &calls), 5, func(int) time.Duration {
+			return time.Hour
+		}, shouldRetry))
+
+		timer := time.NewTimer(time.Millisecond * 20)
+		<-timer.C
+		cancel()
+		<-machine.Done()
+		s.Equal(int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func (s *Suite) TestKeyedTimer() {
+	s.Run("should send the message unless cancelled", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+
+		machine.Send(KeyedTimer("cancelled", time.Millisecond*50, "cancelled"))
+		machine.Send(KeyedTimer("fired", time.Millisecond*50, "fired"))
+		timer := time.NewTimer(time.Millisecond * 20)
+		<-timer.C
+		machine.Send(CancelTimer("cancelled"))
+		machine.Send(CancelTimer("unknown"))
+
+		s.Equal("fired", <-chNotif)
+		timer = time.NewTimer(time.Millisecond * 100)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+
+	s.Run("should reset the delay of a pending timer", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+
+		machine.Send(KeyedTimer("key", time.Millisecond*50, "first"))
+		timer := time.NewTimer(time.Millisecond * 20)
+		<-timer.C
+		machine.Send(KeyedTimer("key", time.Millisecond*50, "second"))
+
+		s.Equal("second", <-chNotif)
+		timer = time.NewTimer(time.Millisecond * 100)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+}
+
+func (s *Suite) TestBufferBy() {
+	s.Run("should flush when the buffer is full", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+		for i := 0; i < 3; i++ {
+			machine.Send(BufferBy("key", 3, time.Hour, i))
+		}
+
+		msg := (<-chNotif).(Buffered)
+		s.Equal("key", msg.Key)
+		s.ElementsMatch([]Msg{0, 1, 2}, msg.Items)
+	})
+
+	s.Run("should flush after the delay", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+		start := time.Now()
+		machine.Send(BufferBy("a", 10, time.Millisecond*50, "a1"))
+		machine.Send(BufferBy("b", 10, time.Millisecond*50, "b1"))
+		machine.Send(BufferBy("a", 10, time.Millisecond*50, "a2"))
+
+		received := map[string][]Msg{}
+		for i := 0; i < 2; i++ {
+			msg := (<-chNotif).(Buffered)
+			received[msg.Key] = msg.Items
+		}
+		s.GreaterOrEqual(time.Since(start), time.Millisecond*50)
+		s.ElementsMatch([]Msg{"a1", "a2"}, received["a"])
+		s.Equal([]Msg{"b1"}, received["b"])
+	})
+}
+
+func (s *Suite) TestReconnect() {
+	backoff := func(attempt int) time.Duration {
+		return time.Millisecond * time.Duration(attempt)
+	}
+
+	s.Run("should retry until connected", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		errConnect := errors.New(s.randString())
+		attempts := int32(0)
+		connect := func(context.Context) (Msg, error) {
+			if atomic.AddInt32(&attempts, 1) <= 2 {
+				return nil, errConnect
+			}
+			return "connected", nil
+		}
+
+		chNotif := make(chan Msg, 3)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+		machine.Send(Reconnect(1, connect, backoff))
+
+		s.Equal(ReconnectScheduled{Attempt: 1, Err: errConnect, Delay: time.Millisecond}, <-chNotif)
+		s.Equal(ReconnectScheduled{Attempt: 2, Err: errConnect, Delay: time.Millisecond * 2}, <-chNotif)
+		s.Equal("connected", <-chNotif)
+		s.Equal(int32(3), atomic.LoadInt32(&attempts))
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		attempts := int32(0)
+		connect := func(context.Context) (Msg, error) {
+			atomic.AddInt32(&attempts, 1)
+			return nil, errors.New("unreachable")
+		}
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil).Maybe()
+		machine := New(ctx, state)
+		machine.Send(Reconnect(1, connect, func(int) time.Duration {
+			return time.Hour
+		}))
+
+		timer := time.NewTimer(time.Millisecond * 20)
+		<-timer.C
+		cancel()
+		<-machine.Done()
+		s.Equal(int32(1), atomic.LoadInt32(&attempts))
+	})
+}
+
+func (s *Suite) TestOnce() {
+	s.Run("should execute the command once per key", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil)
+		machine := New(ctx, state)
+
+		machine.Send(Once("a", ToCmd("a")))
+		s.NoError(machine.WaitIdle(ctx))
+		machine.Send(Once("a", ToCmd("a")))
+		machine.Send(Once("b", ToCmd("b")))
+		s.NoError(machine.WaitIdle(ctx))
+
+		state.AssertNumberOfCalls(s.T(), "Update", 2)
+		state.AssertCalled(s.T(), "Update", "a")
+		state.AssertCalled(s.T(), "Update", "b")
+	})
+
+	s.Run("should reset the keys on restart", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		chNotif := make(chan Msg, 2)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+		machine.Send(Once("key", ToCmd("first")))
+		s.Equal("first", <-chNotif)
+		cancel()
+		<-machine.Done()
+
+		ctx, cancel = context.WithCancel(s.ctx)
+		defer cancel()
+		s.NoError(machine.Restart(ctx, namedState{name: "b", chNotif: chNotif}))
+		machine.Send(Once("key", ToCmd("second")))
+		s.Equal("second", <-chNotif)
+	})
+}
+
+func (s *Suite) TestThrottle() {
+	s.Run("should send one message per cooldown window", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		received := []Msg{}
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			received = append(received, msg)
+			return state, nil
+		})
+		machine := New(ctx, state)
+
+		for _, msg := range []string{"a", "b", "c"} {
+			s.NoError(machine.SendSync(Throttle("key", time.Millisecond*50, msg)))
+		}
+		s.NoError(machine.SendSync(Throttle("other", time.Millisecond*50, "d")))
+
+		timer := time.NewTimer(time.Millisecond * 60)
+		<-timer.C
+		for _, msg := range []string{"e", "f"} {
+			s.NoError(machine.SendSync(Throttle("key", time.Millisecond*50, msg)))
+		}
+
+		s.Equal([]Msg{"a", "d", "e"}, received)
+	})
+
+	s.Run("should throttle the keys again once their cooldown is over", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		received := []Msg{}
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			received = append(received, msg)
+			return state, nil
+		})
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock))
+		send := func(key string, cooldown time.Duration, msg Msg) {
+			s.NoError(machine.SendSync(Throttle(key, cooldown, msg)))
+		}
+
+		send("short", time.Second, "a")
+		send("long", time.Minute, "b")
+		clock.Advance(time.Second)
+		// the expired key is deleted, the other one is still throttled
+		send("short", time.Second, "c")
+		send("long", time.Minute, "d")
+		send("short", time.Second, "e")
+		clock.Advance(time.Minute)
+		send("long", time.Minute, "f")
+
+		s.Equal([]Msg{"a", "b", "c", "f"}, received)
+	})
+}
+
+func (s *Suite) TestCircuitBreaker() {
+	s.Run("should open after repeated failures and close after a success", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock))
+
+		calls := int32(0)
+		failing := int32(1)
+		cmd := CircuitBreaker("api", func() Msg {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				return ErrMsg{Err: errors.New("failed")}
+			}
+			return "ok"
+		}, 2, time.Minute, func(msg Msg) bool {
+			_, failed := msg.(ErrMsg)
+			return failed
+		})
+		send := func() Msg {
+			machine.Send(cmd)
+			return <-chNotif
+		}
+		open := BreakerOpen{Name: "api"}
+
+		// closed
+		s.IsType(ErrMsg{}, send())
+		s.IsType(ErrMsg{}, send())
+		s.Equal(int32(2), atomic.LoadInt32(&calls))
+
+		// open
+		s.Equal(open, send())
+		s.Equal(int32(2), atomic.LoadInt32(&calls))
+
+		// half-open, the trial fails
+		clock.Advance(time.Minute)
+		s.IsType(ErrMsg{}, send())
+		s.Equal(open, send())
+		s.Equal(int32(3), atomic.LoadInt32(&calls))
+
+		// half-open, the trial succeeds
+		clock.Advance(time.Minute)
+		atomic.StoreInt32(&failing, 0)
+		s.Equal("ok", send())
+
+		// closed
+		s.Equal("ok", send())
+		s.Equal(int32(5), atomic.LoadInt32(&calls))
+	})
+
+	s.Run("should classify the messages of the commands sending over time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		machine := New(ctx, state)
+		calls := int32(0)
+		cmd := CircuitBreaker("api", ContextCmd(func(context.Context) Msg {
+			atomic.AddInt32(&calls, 1)
+			return ErrMsg{Err: errors.New("failed")}
+		}), 1, time.Minute, func(msg Msg) bool {
+			_, failed := msg.(ErrMsg)
+			return failed
+		})
+
+		machine.Send(cmd)
+		s.IsType(ErrMsg{}, <-chNotif)
+		machine.Send(cmd)
+		s.Equal(BreakerOpen{Name: "api"}, <-chNotif)
+		s.Equal(int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func (s *Suite) TestCollect() {
+	s.Run("should send the results once in order", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state)
+		machine.Send(Collect(
+			Timer(time.Millisecond*30, "a"),
+			ToCmd(nil),
+			Timer(time.Millisecond*10, "c"),
+		))
+
+		s.Equal(Collected{Results: []Msg{"a", nil, "c"}}, <-chNotif)
+		select {
+		case msg := <-chNotif:
+			s.Failf("unexpected message", "%v", msg)
+		case <-time.After(time.Millisecond * 50):
+		}
+	})
+
+	s.Run("should send nothing when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		machine.Send(Collect(Timer(time.Millisecond*50, "a")))
+		cancel()
+		<-machine.Done()
+	})
+}
+
+func (s *Suite) TestSendPriority() {
+	s.Run("should process the priority message before the buffered ones", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithSynchronousDispatch())
+
+		chGate := make(chan interface{})
+		chNotif := make(chan Msg, DefaultMessageBufferSize+1)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		// block the loop while the buffer is filled
+		machine.Send(ToCmd("gate"))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		for i := 0; i < DefaultMessageBufferSize; i++ {
+			machine.Send(ToCmd(i))
+		}
+		machine.SendPriority(ToCmd("priority"))
+		close(chGate)
+
+		s.Equal("priority", <-chNotif)
+		for i := 0; i < DefaultMessageBufferSize; i++ {
+			s.Equal(i, <-chNotif)
+		}
+	})
+}
+
+func (s *Suite) TestPause() {
+	s.Run("should not process messages while paused", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(3)
+
+		machine := New(ctx, state, WithSynchronousDispatch())
+		machine.Pause()
+		machine.Send(ToCmd("a"))
+		machine.Send(ToCmd("b"))
+		machine.Send(ToCmd("c"))
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		s.Empty(chNotif)
+
+		machine.Resume()
+		s.Equal("a", <-chNotif)
+		s.Equal("b", <-chNotif)
+		s.Equal("c", <-chNotif)
+	})
+
+	s.Run("should not block once the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, mocks.NewStmState(s.T()))
+		cancel()
+		<-machine.Done()
+
+		machine.Pause()
+		machine.Resume()
+	})
+}
+
+// shutdownState is a state recording the call to OnShutdown.
+type shutdownState struct {
+	namedState
+	shutdown chan struct{}
+}
+
+func (s shutdownState) OnShutdown() {
+	close(s.shutdown)
+}
+
+func (s *Suite) TestShutdownState() {
+	s.Run("should notify the current state on termination", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		state := shutdownState{shutdown: make(chan struct{})}
+		machine := New(ctx, state)
+		cancel()
+		<-machine.Done()
+
+		select {
+		case <-state.shutdown:
+		default:
+			s.Fail("OnShutdown was not called")
+		}
+	})
+
+	s.Run("should notify after the shutdown command", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		calls := []string{}
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "bye").Return(func(Msg) (State, Cmd) {
+			calls = append(calls, "update")
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, shutdownRecorder{state, &calls}, WithShutdownCommand(ToCmd("bye"), time.Second))
+		cancel()
+		<-machine.Done()
+		s.Equal([]string{"update", "shutdown"}, calls)
+	})
+}
+
+// shutdownRecorder wraps a state and records the call to OnShutdown.
+type shutdownRecorder struct {
+	State
+	calls *[]string
+}
+
+func (r shutdownRecorder) OnShutdown() {
+	*r.calls = append(*r.calls, "shutdown")
+}
+
+func (s *Suite) TestSelect() {
+	s.Run("should send the first message", func() {
+		start := time.Now()
+		s.Equal([]Msg{"fast"}, s.results(Select(Timer(time.Second, "slow"), ToCmd("fast"))))
+		s.Less(time.Since(start), time.Second)
+	})
+
+	s.Run("should ignore the nil messages", func() {
+		s.Equal([]Msg{"slow"}, s.results(Select(ToCmd(nil), Timer(time.Millisecond*10, "slow"), nil)))
+	})
+
+	s.Run("should send nothing when all the messages are nil", func() {
+		s.Empty(s.results(Select(ToCmd(nil), ToCmd(nil))))
+		s.Empty(s.results(Select()))
+	})
+
+	s.Run("should race the commands sending messages over time", func() {
+		start := time.Now()
+		slow := Retry(Timer(time.Second, "slow"), 1, nil, nil)
+		s.Equal([]Msg{"fast"}, s.results(Select(slow, Timer(time.Millisecond*10, "fast"))))
+		s.Less(time.Since(start), time.Second)
+	})
+}
+
+func (s *Suite) TestYield() {
+	s.Run("should send the message after the buffered ones", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state)
+
+		chGate := make(chan interface{})
+		chNotif := make(chan Msg, 3)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		wait := func() {
+			timer := time.NewTimer(time.Millisecond * 50)
+			<-timer.C
+		}
+
+		// block the loop while the messages are buffered
+		machine.Send(ToCmd("gate"))
+		wait()
+		machine.Send(Yield("yield"))
+		wait()
+		machine.Send(ToCmd("a"))
+		wait()
+		machine.Send(ToCmd("b"))
+		wait()
+		close(chGate)
+
+		s.Equal("a", <-chNotif)
+		s.Equal("b", <-chNotif)
+		s.Equal("yield", <-chNotif)
+	})
+}
+
+func (s *Suite) TestTransitionRewriter() {
+	s.Run("should replace the next state", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		msgInit := s.randString()
+		msg := s.randString()
+
+		state := mocks.NewStmState(s.T())
+		next := mocks.NewStmState(s.T())
+		experiment := mocks.NewStmState(s.T())
+
+		state.On("Update", "start").Return(func(Msg) (State, Cmd) {
+			return next, nil
+		})
+		experiment.On("Init").Return(ToCmd(msgInit))
+		experiment.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return experiment, nil
+		})
+
+		machine := New(ctx, state, WithTransitionRewriter(func(from, to State, cause Msg) State {
+			if to == next {
+				return experiment
+			}
+			return to
+		}))
+		machine.Send(ToCmd("start"))
+		s.Equal(msgInit, <-chNotif)
+
+		machine.Send(ToCmd(msg))
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should only initialize the replacing state", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		msgInit := s.randString()
+		msgAfter := s.randString()
+
+		state := mocks.NewStmState(s.T())
+		next := mocks.NewStmState(s.T())
+		experiment := mocks.NewStmState(s.T())
+
+		state.On("Update", "start").Return(func(Msg) (State, Cmd) {
+			return TransitionTo(next, ToCmd(msgAfter))
+		})
+		next.On("Init").Return(ToCmd(s.randString())).Maybe()
+		experiment.On("Init").Return(ToCmd(msgInit)).Once()
+		experiment.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return experiment, nil
+		})
+
+		machine := New(ctx, state, WithTransitionRewriter(func(from, to State, cause Msg) State {
+			if to == next {
+				return experiment
+			}
+			return to
+		}))
+		machine.Send(ToCmd("start"))
+		s.NoError(machine.WaitIdle(ctx))
+
+		s.ElementsMatch([]Msg{msgInit, msgAfter}, []Msg{<-chNotif, <-chNotif})
+		s.Empty(chNotif)
+		next.AssertNotCalled(s.T(), "Init")
+	})
+}
+
+func (s *Suite) TestCommandMiddleware() {
+	s.Run("should wrap every dispatched command", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		var calls int32
+		count := func(cmd Cmd) Cmd {
+			return func() Msg {
+				atomic.AddInt32(&calls, 1)
+				return cmd()
+			}
+		}
+		// suffix appends to the messages the middlewares it went through,
+		// from the innermost to the outermost.
+		suffix := func(suffix string) func(Cmd) Cmd {
+			return func(cmd Cmd) Cmd {
+				return func() Msg {
+					msg := cmd()
+					if str, ok := msg.(string); ok {
+						return str + suffix
+					}
+					return msg
+				}
+			}
+		}
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil)
+		machine := New(ctx, state,
+			WithCommandMiddleware(count),
+			WithCommandMiddleware(suffix("-outer")),
+			WithCommandMiddleware(suffix("-inner")))
+
+		machine.Send(Batch(ToCmd("a"), ToCmd("b")))
+		s.NoError(machine.WaitIdle(ctx))
+
+		// the batch and each of its commands
+		s.Equal(int32(3), atomic.LoadInt32(&calls))
+		state.AssertCalled(s.T(), "Update", "a-inner-outer")
+		state.AssertCalled(s.T(), "Update", "b-inner-outer")
+	})
+
+	s.Run("should drop the command when the middleware returns nil", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state, WithCommandMiddleware(func(Cmd) Cmd {
+			return nil
+		}))
+		machine.Send(ToCmd(s.randString()))
+		s.NoError(machine.WaitIdle(ctx))
+		state.AssertNotCalled(s.T(), "Update", mock.Anything)
+	})
+}
+
+func (s *Suite) TestMiddleware() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.Run("should transform the messages", func() {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "HELLO").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state, WithMiddleware(func(msg Msg) (Msg, bool) {
+			return strings.ToUpper(msg.(string)), true
+		}))
+		machine.Send(ToCmd("hello"))
+		s.Equal("HELLO", <-chNotif)
+	})
+
+	s.Run("should drop the messages", func() {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "keep").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state, WithSynchronousDispatch(), WithMiddleware(func(msg Msg) (Msg, bool) {
+			return msg, msg != "drop"
+		}))
+		machine.Send(ToCmd("drop"))
+		machine.Send(ToCmd("keep"))
+		s.Equal("keep", <-chNotif)
+	})
+
+	s.Run("should chain the middlewares in registration order", func() {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "msg-a-b").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		suffix := func(suffix string) func(Msg) (Msg, bool) {
+			return func(msg Msg) (Msg, bool) {
+				return msg.(string) + suffix, true
+			}
+		}
+		machine := New(ctx, state, WithMiddleware(suffix("-a")), WithMiddleware(suffix("-b")))
+		machine.Send(ToCmd("msg"))
+		s.Equal("msg-a-b", <-chNotif)
+	})
+
+	s.Run("should call the prepended middlewares first", func() {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "msg-d-c-a-b").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		suffix := func(suffix string) func(Msg) (Msg, bool) {
+			return func(msg Msg) (Msg, bool) {
+				return msg.(string) + suffix, true
+			}
+		}
+		machine := New(ctx, state,
+			WithMiddleware(suffix("-a")),
+			WithMiddlewarePrepend(suffix("-c")),
+			WithMiddlewareAppend(suffix("-b")),
+			WithMiddlewarePrepend(suffix("-d")))
+		machine.Send(ToCmd("msg"))
+		s.Equal("msg-d-c-a-b", <-chNotif)
+	})
+
+	s.Run("should apply the middlewares to the priority messages", func() {
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "URGENT").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state, WithMiddleware(func(msg Msg) (Msg, bool) {
+			return strings.ToUpper(msg.(string)), true
+		}))
+		machine.SendPriority(ToCmd("urgent"))
+		s.Equal("URGENT", <-chNotif)
+	})
+}
+
+func (s *Suite) TestDedup() {
+	s.Run("should drop the duplicates within the window", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		received := []Msg{}
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			received = append(received, msg)
+			return state, nil
+		})
+
+		machine := New(ctx, state, WithDedup(time.Millisecond*50, func(msg Msg) string {
+			if msg == "no key" {
+				return ""
+			}
+			return msg.(string)
+		}))
+
+		for _, msg := range []string{"a", "b", "a", "no key", "no key"} {
+			s.NoError(machine.SendSync(ToCmd(msg)))
+		}
+		timer := time.NewTimer(time.Millisecond * 60)
+		<-timer.C
+		s.NoError(machine.SendSync(ToCmd("a")))
+
+		s.Equal([]Msg{"a", "b", "no key", "no key", "a"}, received)
+	})
+}
+
+func (s *Suite) TestGroup() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.Run("should send the message of each function", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		chNotif := make(chan Msg, 3)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(3)
+
+		running := int32(0)
+		maxRunning := int32(0)
+		fn := func(msg Msg) func(context.Context) (Msg, error) {
+			return func(context.Context) (Msg, error) {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				timer := time.NewTimer(time.Millisecond * 20)
+				<-timer.C
+				return msg, nil
+			}
+		}
+
+		machine.Send(Group(2, fn(1), fn(2), fn(3)))
+
+		received := []Msg{<-chNotif, <-chNotif, <-chNotif}
+		s.ElementsMatch([]Msg{1, 2, 3}, received)
+		s.Equal(int32(2), atomic.LoadInt32(&maxRunning))
+	})
+
+	s.Run("should stop on the first error", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(ctx, state)
+		chNotif := make(chan Msg, 3)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(2)
+
+		err := errors.New(s.randString())
+		machine.Send(Group(1,
+			func(context.Context) (Msg, error) { return 1, nil },
+			func(context.Context) (Msg, error) { return nil, err },
+			func(context.Context) (Msg, error) { return 3, nil },
+		))
+
+		received := []Msg{<-chNotif, <-chNotif}
+		s.Equal([]Msg{1, ErrMsg{Err: err}}, received)
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+
+	s.Run("should cancel the running functions on the first error", func() {
+		err := errors.New(s.randString())
+		result := s.results(Group(2,
+			func(ctx context.Context) (Msg, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			func(context.Context) (Msg, error) { return nil, err },
+		))
+
+		s.Equal([]Msg{ErrMsg{Err: err}}, result)
+	})
+
+	s.Run("should stop when the state machine is terminated", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state)
+
+		chCanceled := make(chan interface{})
+		machine.Send(Group(0, func(ctx context.Context) (Msg, error) {
+			cancel()
+			<-ctx.Done()
+			close(chCanceled)
+			return nil, ctx.Err()
+		}))
+
+		<-chCanceled
+		<-machine.Done()
+	})
+}
+
+func (s *Suite) TestWhen() {
+	s.Run("should execute the command when the predicate holds", func() {
+		relevant := int32(1)
+		pred := func() bool {
+			return atomic.LoadInt32(&relevant) == 1
+		}
+		cmd := When(pred, ToCmd("msg"))
+		s.Equal("msg", cmd())
+
+		// the predicate is evaluated at execution time
+		atomic.StoreInt32(&relevant, 0)
+		s.Nil(cmd())
+	})
+
+	s.Run("should not execute the command when the predicate fails", func() {
+		called := false
+		s.Nil(When(func() bool { return false }, func() Msg {
+			called = true
+			return "msg"
+		})())
+		s.False(called)
+	})
+}
+
+func (s *Suite) TestThen() {
+	s.Run("should execute the follow-up command with the first message", func() {
+		msg := Then(ToCmd(21), func(msg Msg) Cmd {
+			return ToCmd(msg.(int) * 2)
+		})()
+		s.Equal(42, msg)
+	})
+
+	s.Run("should not call next on nil", func() {
+		called := false
+		s.Nil(Then(ToCmd(nil), func(Msg) Cmd {
+			called = true
+			return ToCmd("next")
+		})())
+		s.False(called)
+	})
+
+	s.Run("should send nothing when next returns no command", func() {
+		s.Nil(Then(ToCmd("a"), func(Msg) Cmd {
+			return nil
+		})())
+	})
+
+	s.Run("should call next with the messages sent over time", func() {
+		cmd := Then(Retry(ToCmd(21), 1, nil, nil), func(msg Msg) Cmd {
+			return ToCmd(msg.(int) * 2)
+		})
+		s.Equal([]Msg{42}, s.results(cmd))
+	})
+}
+
+func (s *Suite) TestChain() {
+	// run executes the command in a state machine and returns the first
+	// message received.
+	run := func(cmd Cmd) Msg {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		received := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			received <- msg
+			return state, nil
+		})
+
+		New(ctx, state).Send(cmd)
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	s.Run("should thread the messages through the steps", func() {
+		var steps []Msg
+		step := func(next func(Msg) Msg) func(Msg) Cmd {
+			return func(prev Msg) Cmd {
+				steps = append(steps, prev)
+				return ToCmd(next(prev))
+			}
+		}
+
+		msg := run(Chain(0, "timeout",
+			step(func(Msg) Msg { return 1 }),
+			step(func(prev Msg) Msg { return prev.(int) + 1 }),
+			step(func(prev Msg) Msg { return prev.(int) * 10 }),
+		))
+		s.Equal(20, msg)
+		s.Equal([]Msg{nil, 1, 2}, steps)
+	})
+
+	s.Run("should cancel the running step and the remaining ones on timeout", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithClock(clock))
+
+		var called int32
+		started, canceled := make(chan struct{}), make(chan struct{})
+		machine.Send(Chain(time.Millisecond*50, "timeout",
+			func(Msg) Cmd { return ToCmd(1) },
+			func(Msg) Cmd {
+				return ContextCmd(func(ctx context.Context) Msg {
+					close(started)
+					<-ctx.Done()
+					close(canceled)
+					return 2
+				})
+			},
+			func(Msg) Cmd {
+				atomic.AddInt32(&called, 1)
+				return ToCmd(3)
+			},
+		))
+
+		<-started
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 50)
+		s.Equal("timeout", <-chNotif)
+		<-canceled
+		s.NoError(machine.WaitIdle(ctx))
+		s.Zero(atomic.LoadInt32(&called))
+		s.Empty(chNotif)
+	})
+
+	s.Run("should stop when a step returns nil", func() {
+		msg := run(Batch(
+			Chain(0, "timeout",
+				func(Msg) Cmd { return ToCmd(nil) },
+				func(Msg) Cmd { return ToCmd("unexpected") },
+			),
+			Timer(time.Millisecond*50, "end"),
+		))
+		s.Equal("end", msg)
+	})
+}
+
+func (s *Suite) TestScan() {
+	s.Run("should send the running sum", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+		sum := func(acc, msg Msg) Msg {
+			return acc.(int) + msg.(int)
+		}
+		machine.Send(Scan([]Cmd{ToCmd(1), ToCmd(nil), nil, ToCmd(2), ToCmd(3)}, 10, sum))
+
+		s.Equal(11, <-chNotif)
+		s.Equal(13, <-chNotif)
+		s.Equal(16, <-chNotif)
+	})
+}
+
+func (s *Suite) TestMap() {
+	double := func(msg Msg) Msg {
+		return msg.(int) * 2
+	}
+
+	s.Run("should transform the message", func() {
+		s.Equal(6, Map(ToCmd(3), double)())
+	})
+
+	s.Run("should not call fn on nil", func() {
+		called := false
+		s.Nil(Map(ToCmd(nil), func(msg Msg) Msg {
+			called = true
+			return msg
+		})())
+		s.False(called)
+	})
+
+	s.Run("should transform each message of a batch", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Twice()
+
+		machine := New(ctx, state)
+		machine.Send(Map(Batch(ToCmd(1), ToCmd(2)), double))
+		s.ElementsMatch([]Msg{2, 4}, []Msg{<-chNotif, <-chNotif})
+	})
+
+	s.Run("should transform the messages sent over time", func() {
+		s.Equal([]Msg{6}, s.results(Map(Retry(ToCmd(3), 1, nil, nil), double)))
+	})
+}
+
+func (s *Suite) TestReply() {
+	s.Run("should send the message to the machine and the channel", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state)
+		reply := make(chan Msg, 1)
+		msg := s.randString()
+		machine.Send(Reply(ToCmd(msg), reply))
+
+		s.Equal(msg, <-reply)
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should reply each message of a batch", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil).Twice()
+
+		machine := New(ctx, state)
+		reply := make(chan Msg, 3)
+		machine.Send(Reply(Batch(ToCmd("a"), ToCmd(nil), ToCmd("b")), reply))
+
+		s.NoError(machine.WaitIdle(ctx))
+		s.ElementsMatch([]Msg{"a", "b"}, []Msg{<-reply, <-reply})
+		s.Empty(reply)
+	})
+
+	s.Run("should not block on a full channel", func() {
+		reply := make(chan Msg)
+		s.Equal("a", Reply(ToCmd("a"), reply)())
+		s.Nil(Reply(ToCmd(nil), reply)())
+	})
+}
+
+func (s *Suite) TestPipeline() {
+	double := func(msg Msg) Msg {
+		return msg.(int) * 2
+	}
+
+	s.Run("should apply the stages in order", func() {
+		inc := func(msg Msg) Msg {
+			return msg.(int) + 1
+		}
+		s.Equal(8, Pipeline(ToCmd(3), inc, double)())
+		s.Equal(7, Pipeline(ToCmd(3), double, inc)())
+		s.Equal(3, Pipeline(ToCmd(3))())
+	})
+
+	s.Run("should stop when a stage returns nil", func() {
+		called := false
+		drop := func(Msg) Msg {
+			return nil
+		}
+		spy := func(msg Msg) Msg {
+			called = true
+			return msg
+		}
+		s.Nil(Pipeline(ToCmd(3), double, drop, spy)())
+		s.Nil(Pipeline(ToCmd(nil), spy)())
+		s.False(called)
+	})
+
+	s.Run("should pass each message of a batch through the stages", func() {
+		s.ElementsMatch([]Msg{2, 4}, s.results(Pipeline(Batch(ToCmd(1), ToCmd(2)), double)))
+	})
+}
+
+// namedState is a comparable state forwarding every message to a channel.
+type namedState struct {
+	name    string
+	chNotif chan Msg
+}
+
+func (n namedState) Init() Cmd {
+	return nil
+}
+
+func (n namedState) Update(msg Msg) (State, Cmd) {
+	n.chNotif <- msg
+	if next, ok := msg.(namedState); ok {
+		return next, nil
+	}
+	return n, nil
+}
+
+// stringState is a state implementing fmt.Stringer, it transitions to the
+// stringState it receives.
+type stringState struct {
+	namedState
+}
+
+func (s stringState) Update(msg Msg) (State, Cmd) {
+	s.chNotif <- msg
+	if next, ok := msg.(stringState); ok {
+		return next, nil
+	}
+	return s, nil
+}
+
+func (s stringState) String() string {
+	return "state " + s.name
+}
+
+// initState records the calls to Init and Update, without synchronization,
+// and transitions to itself with each message.
+type initState struct {
+	calls *[]string
+}
+
+func (i initState) Init() Cmd {
+	*i.calls = append(*i.calls, "init")
+	return nil
+}
+
+func (i initState) Update(Msg) (State, Cmd) {
+	*i.calls = append(*i.calls, "update")
+	return TransitionTo(i)
+}
+
+// counterState adds the ints it receives to Count and renames itself with
+// the strings.
+type counterState struct {
+	Count int
+	Label string
+	seen  int
+}
+
+func (c counterState) Init() Cmd {
+	return nil
+}
+
+func (c counterState) Update(msg Msg) (State, Cmd) {
+	c.seen++
+	switch msg := msg.(type) {
+	case int:
+		c.Count += msg
+	case string:
+		c.Label = msg
+	}
+	return c, nil
+}
+
+// senderState sends the messages with the sender when it is initialized and
+// returns a command sending init.
+type senderState struct {
+	namedState
+	msgs []Msg
+	init Msg
+}
+
+func (s senderState) InitWithSender(sender Sender) Cmd {
+	for _, msg := range s.msgs {
+		sender.Send(ToCmd(msg))
+	}
+	return ToCmd(s.init)
+}
+
+// fakeMetrics counts the calls to each method of Metrics and records the
+// longest command.
+type fakeMetrics struct {
+	processed   int32
+	started     int32
+	finished    int32
+	transitions int32
+	longest     int64
+}
+
+func (m *fakeMetrics) MessageProcessed(Msg) {
+	atomic.AddInt32(&m.processed, 1)
+}
+
+func (m *fakeMetrics) CommandStarted() {
+	atomic.AddInt32(&m.started, 1)
+}
+
+func (m *fakeMetrics) CommandFinished(d time.Duration) {
+	atomic.AddInt32(&m.finished, 1)
+	for {
+		longest := atomic.LoadInt64(&m.longest)
+		if int64(d) <= longest || atomic.CompareAndSwapInt64(&m.longest, longest, int64(d)) {
+			return
+		}
+	}
+}
+
+func (m *fakeMetrics) Transition(from, to State) {
+	atomic.AddInt32(&m.transitions, 1)
+}
+
+func (s *Suite) TestMetrics() {
+	s.Run("should record the counts", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		metrics := &fakeMetrics{}
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithMetrics(metrics))
+
+		machine.Send(ToCmd("stay"))
+		s.NoError(machine.WaitIdle(ctx))
+		machine.Send(ToCmd(namedState{name: "b", chNotif: chNotif}))
+		s.NoError(machine.WaitIdle(ctx))
+
+		s.Equal(int32(2), atomic.LoadInt32(&metrics.processed))
+		s.Equal(int32(2), atomic.LoadInt32(&metrics.started))
+		s.Equal(int32(2), atomic.LoadInt32(&metrics.finished))
+		s.Equal(int32(1), atomic.LoadInt32(&metrics.transitions))
+	})
+
+	s.Run("should time the commands sending messages over time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		metrics := &fakeMetrics{}
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithMetrics(metrics))
+
+		sleep := time.Millisecond * 50
+		machine.Send(ContextCmd(func(context.Context) Msg {
+			timer := time.NewTimer(sleep)
+			defer timer.Stop()
+			<-timer.C
+			return "done"
+		}))
+		s.NoError(machine.WaitIdle(ctx))
+
+		s.Equal(int32(1), atomic.LoadInt32(&metrics.finished))
+		s.GreaterOrEqual(time.Duration(atomic.LoadInt64(&metrics.longest)), sleep)
+	})
+}
+
+func (s *Suite) TestMatch() {
+	next := namedState{name: "next"}
+	update := func(msg Msg) (State, Cmd, bool) {
+		if state, cmd, ok := Match(msg, func(m string) (State, Cmd) {
+			return next, ToCmd("string " + m)
+		}); ok {
+			return state, cmd, ok
+		}
+		return Match(msg, func(m int) (State, Cmd) {
+			return next, ToCmd(m * 2)
+		})
+	}
+
+	s.Run("should call the function of the matching type", func() {
+		state, cmd, ok := update("a")
+		s.True(ok)
+		s.Equal(next, state)
+		s.Equal("string a", cmd())
+
+		state, cmd, ok = update(21)
+		s.True(ok)
+		s.Equal(next, state)
+		s.Equal(42, cmd())
+	})
+
+	s.Run("should report when no type matches", func() {
+		state, cmd, ok := update(1.5)
+		s.False(ok)
+		s.Nil(state)
+		s.Nil(cmd)
+	})
+}
+
+func (s *Suite) TestStateName() {
+	s.Run("should use String when implemented", func() {
+		s.Equal("state a", StateName(stringState{namedState{name: "a"}}))
+	})
+
+	s.Run("should fall back to the type name", func() {
+		s.Equal("stm_test.namedState", StateName(namedState{name: "a"}))
+		s.Equal("<nil>", StateName(nil))
+	})
+}
+
+func (s *Suite) TestPushPop() {
+	s.Run("should return to the pushed state", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		base := mocks.NewStmState(s.T())
+		dialog := mocks.NewStmState(s.T())
+
+		base.On("Update", "open").Return(func(Msg) (State, Cmd) {
+			return Push(dialog)
+		}).Once()
+		dialog.On("Init").Return(ToCmd("dialog init")).Once()
+		dialog.On("Update", "dialog init").Return(dialog, nil).Once()
+		dialog.On("Update", "confirm").Return(func(Msg) (State, Cmd) {
+			return Pop()
+		}).Once()
+		base.On("Update", "after").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return base, nil
+		}).Once()
+
+		machine := New(ctx, base, WithSynchronousDispatch())
+		s.NoError(machine.SendSync(ToCmd("open")))
+		s.Equal(dialog, machine.State())
+
+		s.NoError(machine.SendSync(ToCmd("confirm")))
+		s.Equal(base, machine.State())
+
+		// the base state resumes without calling its Init method
+		s.NoError(machine.SendSync(ToCmd("after")))
+		s.Equal("after", <-chNotif)
+	})
+
+	s.Run("should keep the state when the stack is empty", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "pop").Return(func(Msg) (State, Cmd) {
+			return Pop()
+		}).Once()
+
+		machine := New(ctx, state)
+		s.NoError(machine.SendSync(ToCmd("pop")))
+		s.Equal(state, machine.State())
+	})
+}
+
+func (s *Suite) TestOnTransition() {
+	s.Run("should only be called when the state changes", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		a := namedState{name: "a", chNotif: chNotif}
+		b := namedState{name: "b", chNotif: chNotif}
+
+		transitions := [][2]string{}
+		machine := New(ctx, a, WithSynchronousDispatch(), WithOnTransition(func(from, to State) {
+			transitions = append(transitions, [2]string{from.(namedState).name, to.(namedState).name})
+		}))
+
+		s.NoError(machine.SendSync(ToCmd("stay")))
+		s.NoError(machine.SendSync(ToCmd(b)))
+		s.NoError(machine.SendSync(ToCmd(b)))
+		s.NoError(machine.SendSync(ToCmd(a)))
+
+		s.Equal([][2]string{{"a", "b"}, {"b", "a"}}, transitions)
+	})
+
+	s.Run("should compare the states that are not comparable", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		transitions := 0
+		machine := New(ctx, listState{}, WithOnTransition(func(from, to State) {
+			transitions++
+		}))
+
+		s.NoError(machine.SendSync(ToCmd("a")))
+		s.NoError(machine.SendSync(ToCmd(nil)))
+		s.NoError(machine.SendSync(ToCmd("stay")))
+		s.NoError(machine.SendSync(ToCmd("b")))
+		s.Equal(2, transitions)
+		s.Equal(listState{items: []string{"a", "b"}}, machine.State())
+	})
+}
+
+// listState is a state that is not comparable, it appends the strings it
+// receives to its items, except "stay" which returns a copy of the state.
+type listState struct {
+	items []string
+}
+
+func (l listState) Init() Cmd {
+	return nil
+}
+
+func (l listState) Update(msg Msg) (State, Cmd) {
+	if msg == "stay" {
+		return listState{items: append([]string{}, l.items...)}, nil
+	}
+	return listState{items: append(l.items, msg.(string))}, nil
+}
+
+func (s *Suite) TestHistory() {
+	s.Run("should record the last transitions in order", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		states := []namedState{}
+		for _, name := range []string{"a", "b", "c", "d"} {
+			states = append(states, namedState{name: name, chNotif: chNotif})
+		}
+
+		machine := New(ctx, states[0], WithHistory(2))
+		s.Empty(machine.History())
+
+		start := time.Now()
+		for _, next := range states[1:] {
+			s.NoError(machine.SendSync(ToCmd(next)))
+			// staying in the same state is not a transition
+			s.NoError(machine.SendSync(ToCmd("stay")))
+		}
+
+		history := machine.History()
+		s.Len(history, 2)
+		s.Equal(states[1], history[0].From)
+		s.Equal(states[2], history[0].To)
+		s.Equal(states[2], history[0].Trigger)
+		s.Equal(states[2], history[1].From)
+		s.Equal(states[3], history[1].To)
+		s.False(history[0].At.Before(start))
+		s.False(history[1].At.Before(history[0].At))
+	})
+
+	s.Run("should export the transitions as JSON", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		newState := func(name string) stringState {
+			return stringState{namedState{name: name, chNotif: chNotif}}
+		}
+		machine := New(ctx, newState("a"), WithHistory(10))
+		s.NoError(machine.SendSync(ToCmd(newState("b"))))
+		s.NoError(machine.SendSync(ToCmd(newState("c"))))
+
+		data, err := machine.ExportHistory()
+		s.Require().NoError(err)
+
+		var exported []struct {
+			From    string
+			To      string
+			At      time.Time
+			Trigger string
+			Msg     json.RawMessage
+		}
+		s.Require().NoError(json.Unmarshal(data, &exported))
+		s.Require().Len(exported, 2)
+		s.Equal("state a", exported[0].From)
+		s.Equal("state b", exported[0].To)
+		s.Equal("state b", exported[1].From)
+		s.Equal("state c", exported[1].To)
+		s.Equal("stm_test.stringState", exported[1].Trigger)
+		s.False(exported[1].At.IsZero())
+
+		s.JSONEq(`{}`, string(exported[1].Msg))
+	})
+
+	s.Run("should omit the messages that can't be marshaled", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		next := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(next, nil).Once()
+		machine := New(ctx, state, WithHistory(1))
+		s.NoError(machine.SendSync(ToCmd(make(chan int))))
+
+		data, err := machine.ExportHistory()
+		s.Require().NoError(err)
+		s.Contains(string(data), `"trigger":"chan int"`)
+		s.NotContains(string(data), `"msg"`)
+	})
+
+	s.Run("should be disabled by default", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+		s.NoError(machine.SendSync(ToCmd(namedState{name: "b", chNotif: chNotif})))
+		s.Empty(machine.History())
+	})
+}
+
+func (s *Suite) TestTransitionCheckpoint() {
+	s.Run("should checkpoint every n transitions", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		states := []namedState{}
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			states = append(states, namedState{name: name, chNotif: chNotif})
+		}
+
+		machine := New(ctx, states[0], WithTransitionCheckpoint(2, func(state State) Msg {
+			return "checkpoint " + state.(namedState).name
+		}))
+
+		checkpoints := []Msg{}
+		send := func(next namedState) {
+			machine.Send(ToCmd(next))
+			for msg := range chNotif {
+				if msg == next {
+					return
+				}
+				checkpoints = append(checkpoints, msg)
+			}
+		}
+
+		for _, next := range states[1:] {
+			send(next)
+		}
+		// staying in the same state is not a transition
+		send(states[4])
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		for len(chNotif) > 0 {
+			checkpoints = append(checkpoints, <-chNotif)
+		}
+		s.ElementsMatch([]Msg{"checkpoint c", "checkpoint e"}, checkpoints)
+	})
+
+	s.Run("should not dispatch a nil checkpoint", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		metrics := &fakeMetrics{}
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif},
+			WithMetrics(metrics),
+			WithTransitionCheckpoint(1, func(State) Msg {
+				return nil
+			}))
+
+		s.NoError(machine.SendSync(ToCmd(namedState{name: "b", chNotif: chNotif})))
+		s.NoError(machine.WaitIdle(ctx))
+		s.Zero(atomic.LoadInt32(&metrics.started))
+	})
+}
+
+func (s *Suite) TestSequence() {
+	s.Run("should deliver the messages in order", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state)
+
+		chNotif := make(chan Msg, 3)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			if msg == "a" {
+				// the next command must wait for this message
+				timer := time.NewTimer(time.Millisecond * 50)
+				<-timer.C
+			}
+			chNotif <- msg
+			return state, nil
+		}).Times(3)
+
+		machine.Send(Sequence(
+			Timer(time.Millisecond*50, "a"),
+			ToCmd(nil),
+			nil,
+			ToCmd("b"),
+			ToCmd("c"),
+		))
+
+		s.Equal("a", <-chNotif)
+		s.Equal("b", <-chNotif)
+		s.Equal("c", <-chNotif)
+	})
+
+	s.Run("should stop when the machine is terminated", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, state)
+
+		called := make(chan interface{}, 1)
+		machine.Send(Sequence(
+			func() Msg {
+				cancel()
+				return nil
+			},
+			func() Msg {
+				called <- nil
+				return nil
+			},
+		))
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		s.Empty(called)
+	})
+}
+
+func (s *Suite) TestState() {
+	s.Run("should return the current state", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := namedState{name: "a", chNotif: chNotif}
+		next := namedState{name: "b", chNotif: chNotif}
+
+		machine := New(ctx, state)
+		s.Equal(state, machine.State())
+
+		machine.Send(ToCmd(next))
+		<-chNotif
+		s.Eventually(func() bool {
+			return machine.State() == next
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func (s *Suite) TestClock() {
+	s.Run("should use the clock for the time based commands", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock))
+		machine.Send(Tick(time.Hour, "tick"))
+		machine.Send(TimerAt(clock.Now().Add(time.Minute*90), "deadline"))
+		clock.BlockUntil(2)
+
+		clock.Advance(time.Hour)
+		s.Equal("tick", <-chNotif)
+		clock.Advance(time.Minute * 30)
+		s.Equal("deadline", <-chNotif)
+		clock.Advance(time.Minute * 30)
+		s.Equal("tick", <-chNotif)
+	})
+
+	s.Run("should use the clock for the timeout of a TimedState", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := &timedState{
+			StmState: mocks.NewStmState(s.T()),
+			timeout:  time.Hour,
+			msg:      "timeout",
+		}
+		state.On("Update", "timeout").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return mocks.NewStmState(s.T()), nil
+		}).Once()
+
+		clock := stmtest.NewFakeClock(time.Now())
+		New(ctx, state, WithClock(clock))
+		clock.BlockUntil(1)
+		clock.Advance(time.Hour)
+		s.Equal("timeout", <-chNotif)
+	})
+
+	s.Run("should use the clock for Timer, Timed and the lifetime", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock), WithMaxLifetime(time.Hour*2))
+		machine.Send(Timed(Timer(time.Hour, "timer"), func(msg Msg, d time.Duration) Msg {
+			return d
+		}))
+		machine.Send(Timer(time.Hour, "timer"))
+		clock.BlockUntil(3)
+
+		clock.Advance(time.Hour)
+		s.ElementsMatch([]Msg{time.Hour, "timer"}, []Msg{<-chNotif, <-chNotif})
+		s.Nil(machine.Err())
+
+		clock.Advance(time.Hour)
+		<-machine.Done()
+		s.ErrorIs(machine.Err(), ErrLifetimeExceeded)
+	})
+
+	s.Run("should use the clock for the timeout of TransitionToWithTimeout", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		next := mocks.NewStmState(s.T())
+		next.On("Init").Return(Timer(time.Hour*2, "init")).Once()
+		next.On("Update", "timeout").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return next, nil
+		}).Once()
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "start").Return(func(Msg) (State, Cmd) {
+			return TransitionToWithTimeout(next, time.Hour, "timeout")
+		}).Once()
+
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock))
+		machine.Send(ToCmd("start"))
+		clock.BlockUntil(2)
+
+		clock.Advance(time.Hour)
+		s.Equal("timeout", <-chNotif)
+	})
+}
+
+func (s *Suite) TestTimerAt() {
+	newMachine := func(ctx context.Context) (*Stm, chan time.Time) {
+		chNotif := make(chan time.Time, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "deadline").Return(func(Msg) (State, Cmd) {
+			chNotif <- time.Now()
+			return state, nil
+		}).Once()
+		return New(ctx, state), chNotif
+	}
+
+	s.Run("should send the message at the deadline", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		machine, chNotif := newMachine(ctx)
+		deadline := time.Now().Add(time.Millisecond * 50)
+		machine.Send(TimerAt(deadline, "deadline"))
+		s.False((<-chNotif).Before(deadline))
+	})
+
+	s.Run("should send the message immediately when the deadline is past", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		machine, chNotif := newMachine(ctx)
+		start := time.Now()
+		machine.Send(TimerAt(start.Add(-time.Hour), "deadline"))
+		s.Less((<-chNotif).Sub(start), time.Millisecond*25)
+	})
+
+	s.Run("should not send the message when the machine is terminated", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+			machine := New(ctx, mocks.NewStmState(s.T()))
+			machine.Send(TimerAt(time.Now().Add(time.Hour), "deadline"))
+			cancel()
+			<-machine.Done()
+		})
+	})
+
+	s.Run("should race a command with Select", func() {
+		work := Timer(time.Millisecond*10, "work")
+		s.Equal([]Msg{"work"}, s.results(Select(work, TimerAt(time.Now().Add(time.Second), "deadline"))))
+
+		late := Timer(time.Second, "work")
+		s.Equal([]Msg{"deadline"}, s.results(Select(late, TimerAt(time.Now().Add(time.Millisecond*10), "deadline"))))
+	})
+}
+
+func (s *Suite) TestTick() {
+	s.Run("should send the message at each tick until termination", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			state := mocks.NewStmState(s.T())
+			ctx, cancel := context.WithCancel(s.ctx)
+			machine := New(ctx, state)
+
+			chNotif := make(chan Msg, 10)
+			msg := s.randString()
+			state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+				chNotif <- msg
+				return state, nil
+			})
+
+			start := time.Now()
+			machine.Send(Tick(time.Millisecond*20, msg))
+			for i := 0; i < 3; i++ {
+				s.Equal(msg, <-chNotif)
+			}
+			s.True(time.Since(start) >= time.Millisecond*60)
+			s.True(time.Since(start) < time.Millisecond*500)
+			cancel()
+		})
+	})
+}
+
+func (s *Suite) TestEvery() {
+	s.Run("should send the message immediately then at each interval", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			state := mocks.NewStmState(s.T())
+			ctx, cancel := context.WithCancel(s.ctx)
+			machine := New(ctx, state)
+
+			chNotif := make(chan time.Duration, 10)
+			msg := s.randString()
+			start := time.Now()
+			state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+				chNotif <- time.Since(start)
+				return state, nil
+			})
+
+			machine.Send(Every(time.Millisecond*50, msg))
+			s.Less(<-chNotif, time.Millisecond*25)
+			s.GreaterOrEqual(<-chNotif, time.Millisecond*50)
+			s.GreaterOrEqual(<-chNotif, time.Millisecond*100)
+			cancel()
+		})
+	})
+}
+
+func (s *Suite) TestFromTicker() {
+	s.Run("should send a message for each tick without stopping the ticker", func() {
+		ticker := time.NewTicker(time.Millisecond * 10)
+		defer ticker.Stop()
+
+		stmtest.AssertNoLeaks(s.T(), func() {
+			state := mocks.NewStmState(s.T())
+			ctx, cancel := context.WithCancel(s.ctx)
+			machine := New(ctx, state)
+
+			chNotif := make(chan Msg, 10)
+			state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+				chNotif <- msg
+				return state, nil
+			})
+
+			machine.Send(FromTicker(ticker, func(t time.Time) Msg {
+				return t
+			}))
+			s.IsType(time.Time{}, <-chNotif)
+			s.IsType(time.Time{}, <-chNotif)
+			cancel()
+			<-machine.Done()
+		})
+
+		// the ticker is still running
+		<-ticker.C
+	})
+}
+
+func (s *Suite) TestHeartbeat() {
+	s.Run("should send the message when a beat fails", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "lost").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		beats := int32(0)
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock))
+		machine.Send(Heartbeat(time.Second, func() error {
+			if atomic.AddInt32(&beats, 1) == 3 {
+				return errors.New("lease lost")
+			}
+			return nil
+		}, "lost"))
+		clock.BlockUntil(1)
+
+		for i := 0; i < 3; i++ {
+			clock.Advance(time.Second)
+			s.Eventually(func() bool {
+				return atomic.LoadInt32(&beats) == int32(i+1)
+			}, time.Second, time.Millisecond)
+		}
+		s.Equal("lost", <-chNotif)
+
+		// the heartbeat stopped
+		s.Require().NoError(machine.WaitIdle(ctx))
+		s.Equal(int32(3), atomic.LoadInt32(&beats))
+	})
+}
+
+func (s *Suite) TestOnMemoryPressure() {
+	s.Run("should send the message once the heap exceeds the threshold", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, state, WithClock(clock))
+		machine.Send(OnMemoryPressure(0, "pressure"))
+		machine.Send(OnMemoryPressure(math.MaxUint64, "never"))
+		clock.BlockUntil(2)
+
+		clock.Advance(MemoryPressureInterval)
+		s.Equal("pressure", <-chNotif)
+
+		// sent once while the heap stays above the threshold
+		clock.Advance(MemoryPressureInterval)
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+}
+
+func (s *Suite) TestPanicRecovery() {
+	s.Run("should send a message when a command panics", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithPanicRecovery())
+
+		chNotif := make(chan Msg, 1)
+		state.On("Update", mock.AnythingOfType("stm.CmdPanic")).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		err := errors.New(s.randString())
+		machine.Send(func() Msg {
+			panic(err)
+		})
+
+		msg := (<-chNotif).(CmdPanic)
+		s.ErrorIs(msg.Err, err)
+		s.NotEmpty(msg.Stack)
+	})
+}
+
+// exitState is a namedState notified when it is left.
+type exitState struct {
+	namedState
+	exitMsg Msg
+}
+
+func (e exitState) OnExit() Cmd {
+	return ToCmd(e.exitMsg)
+}
+
+// leavingState is an exitState that transitions with TransitionTo to next
+// when it receives "leave". Its OnExit command is slow, to check that it
+// still runs before the Init command of next.
+type leavingState struct {
+	exitState
+	next State
+}
+
+func (l leavingState) Update(msg Msg) (State, Cmd) {
+	if msg == "leave" {
+		return TransitionTo(l.next)
+	}
+	return l.exitState.Update(msg)
+}
+
+func (l leavingState) OnExit() Cmd {
+	return func() Msg {
+		timer := time.NewTimer(time.Millisecond * 20)
+		<-timer.C
+		return l.exitMsg
+	}
+}
+
+func (e exitState) Update(msg Msg) (State, Cmd) {
+	next, cmd := e.namedState.Update(msg)
+	if next == e.namedState {
+		return e, cmd
+	}
+	return next, cmd
+}
+
+func (s *Suite) TestExitState() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.Run("should exit the previous state", func() {
+		chNotif := make(chan Msg, 3)
+		msg := s.randString()
+		msgExit := s.randString()
+		state := exitState{
+			namedState: namedState{name: "a", chNotif: chNotif},
+			exitMsg:    msgExit,
+		}
+		next := namedState{name: "b", chNotif: chNotif}
+
+		machine := New(ctx, state)
+
+		// staying in the state doesn't exit it
+		machine.Send(ToCmd(msg))
+		s.Equal(msg, <-chNotif)
+
+		machine.Send(ToCmd(next))
+		s.Equal(next, <-chNotif)
+		s.Equal(msgExit, <-chNotif)
+	})
+
+	s.Run("should ignore states without OnExit", func() {
+		chNotif := make(chan Msg, 3)
+		state := namedState{name: "a", chNotif: chNotif}
+		next := namedState{name: "b", chNotif: chNotif}
+
+		machine := New(ctx, state)
+		machine.Send(ToCmd(next))
+		s.Equal(next, <-chNotif)
+
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		s.Empty(chNotif)
+	})
+
+	s.Run("should run OnExit before the Init of the new state", func() {
+		chNotif := make(chan Msg, 2)
+		msgExit := s.randString()
+		msgInit := s.randString()
+
+		next := mocks.NewStmState(s.T())
+		next.On("Init").Return(ToCmd(msgInit)).Once()
+		next.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return next, nil
+		})
+		state := leavingState{
+			exitState: exitState{exitMsg: msgExit},
+			next:      next,
+		}
+
+		New(ctx, state).Send(ToCmd("leave"))
+		s.Equal(msgExit, <-chNotif)
+		s.Equal(msgInit, <-chNotif)
+	})
+}
+
+func (s *Suite) TestTrySend() {
+	s.Run("should report when the buffer is full", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithMessageBufferSize(1))
+
+		chGate := make(chan interface{})
+		chNotif := make(chan Msg, 1)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		msg := s.randString()
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		// block the loop so the buffer fills up
+		s.True(<-machine.TrySend(ToCmd("gate")))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+
+		s.True(<-machine.TrySend(ToCmd(msg)))
+		s.False(<-machine.TrySend(ToCmd(s.randString())))
+		s.False(<-machine.TrySend(ContextCmd(func(context.Context) Msg {
+			return s.randString()
+		})))
+		s.True(<-machine.TrySend(ToCmd(nil)))
+
+		close(chGate)
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should drop the message when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, mocks.NewStmState(s.T()))
+		cancel()
+		s.False(<-machine.TrySend(ToCmd(s.randString())))
+	})
+
+	s.Run("should report the messages sent over time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 1)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+
+		s.True(<-machine.TrySend(Timer(time.Millisecond, "timer")))
+		s.Equal("timer", <-chNotif)
+		s.True(<-machine.TrySend(ContextCmd(func(context.Context) Msg {
+			return nil
+		})))
+	})
+}
+
+func (s *Suite) TestFullBufferPolicy() {
+	// run fills a buffer of size 1 while the loop is blocked and returns the
+	// messages received once it is released.
+	run := func(policy FullBufferPolicy) []Msg {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state,
+			WithMessageBufferSize(1),
+			WithSynchronousDispatch(),
+			WithFullBufferPolicy(policy))
+
+		chGate := make(chan interface{})
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		chNotif := make(chan Msg, 2)
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		})
+
+		// block the loop so the buffer fills up
+		machine.Send(ToCmd("gate"))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		machine.Send(ToCmd(1))
+		machine.Send(ToCmd(2))
+		close(chGate)
+
+		var received []Msg
+		for {
+			select {
+			case msg := <-chNotif:
+				received = append(received, msg)
+			case <-time.After(time.Millisecond * 100):
+				return received
+			}
+		}
+	}
+
+	s.Run("should keep all the messages when blocking", func() {
+		s.Equal([]Msg{1, 2}, run(BlockPolicy))
+	})
+
+	s.Run("should drop the incoming message", func() {
+		s.Equal([]Msg{1}, run(DropNewest))
+	})
+
+	s.Run("should drop the oldest message", func() {
+		s.Equal([]Msg{2}, run(DropOldest))
+	})
+}
+
+func (s *Suite) TestRequest() {
+	s.Run("should return the message of the command", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		msg := s.randString()
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+		machine := New(ctx, state)
+
+		res, err := machine.Request(ctx, ToCmd(msg))
+		s.NoError(err)
+		s.Equal(msg, res)
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should return the first message sent over time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		msg := s.randString()
+		chNotif := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+		machine := New(ctx, state)
+
+		res, err := machine.Request(ctx, Timer(time.Millisecond*10, msg))
+		s.NoError(err)
+		s.Equal(msg, res)
+		s.Equal(msg, <-chNotif)
+
+		res, err = machine.Request(ctx, Select())
+		s.NoError(err)
+		s.Nil(res)
+	})
+
+	s.Run("should return an error on timeout", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, mocks.NewStmState(s.T()))
+
+		reqCtx, reqCancel := context.WithTimeout(ctx, time.Millisecond*50)
+		defer reqCancel()
+		res, err := machine.Request(reqCtx, Timer(time.Second, s.randString()))
+		s.ErrorIs(err, context.DeadlineExceeded)
+		s.Nil(res)
+	})
+
+	s.Run("should return an error when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, mocks.NewStmState(s.T()))
+		cancel()
+
+		_, err := machine.Request(s.ctx, ToCmd(s.randString()))
+		s.ErrorIs(err, ErrTerminated)
+	})
+}
+
+func (s *Suite) TestQueueLen() {
+	s.Run("should report the depth of the buffer", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithMessageBufferSize(5), WithSynchronousDispatch())
+		s.Equal(5, machine.QueueCap())
+		s.Equal(0, machine.QueueLen())
+
+		chGate := make(chan interface{})
+		defer close(chGate)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		state.On("Update", mock.Anything).Return(state, nil).Maybe()
+
+		// block the loop so the buffer fills up
+		machine.Send(ToCmd("gate"))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		for i := 0; i < 3; i++ {
+			machine.Send(ToCmd(i))
+		}
+		s.Equal(3, machine.QueueLen())
+	})
+}
+
+func (s *Suite) TestErrors() {
+	s.Run("should report the dropped messages", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithMessageBufferSize(1))
+
+		chGate := make(chan interface{})
+		defer close(chGate)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		state.On("Update", mock.Anything).Return(state, nil).Maybe()
+
+		// block the loop so the buffer fills up
+		s.True(<-machine.TrySend(ToCmd("gate")))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+
+		s.True(<-machine.TrySend(ToCmd("a")))
+		s.False(<-machine.TrySend(ToCmd("b")))
+		s.ErrorIs(<-machine.Errors(), ErrDropped)
+	})
+
+	s.Run("should report the recovered panics", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithPanicRecovery())
+		state.On("Update", mock.AnythingOfType("stm.CmdPanic")).Return(state, nil).Maybe()
+
+		err := errors.New(s.randString())
+		machine.Send(func() Msg {
+			panic(err)
+		})
+		s.ErrorIs(<-machine.Errors(), err)
+	})
+
+	s.Run("should report the commands of a batch not dispatched", func() {
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(state, nil).Maybe()
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, state, WithSynchronousDispatch())
+
+		var executed int32
+		cmds := make([]Cmd, 100)
+		for i := range cmds {
+			cmds[i] = func() Msg {
+				// terminate the machine in the middle of the batch
+				if atomic.AddInt32(&executed, 1) == 40 {
+					cancel()
+				}
+				return nil
+			}
+		}
+		machine.Send(Batch(cmds...))
+
+		err := <-machine.Errors()
+		s.ErrorIs(err, ErrUndispatched)
+		s.Contains(err.Error(), "60 of 100")
+		s.Equal(int32(40), atomic.LoadInt32(&executed))
+
+		var undispatched UndispatchedError
+		s.Require().ErrorAs(err, &undispatched)
+		s.Equal(100, undispatched.Size)
+		s.Len(undispatched.Indices, 60)
+		s.Equal(40, undispatched.Indices[0])
+	})
+
+	s.Run("should report the messages dropped on termination", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chGate := make(chan interface{})
+		defer close(chGate)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		machine := New(ctx, state, WithMessageBufferSize(1))
+
+		// block the loop and fill the buffer
+		machine.Send(ToCmd("gate"))
+		s.Eventually(func() bool {
+			return machine.QueueLen() == 0
+		}, time.Second, time.Millisecond)
+		machine.Send(ToCmd("buffered"))
+		machine.Send(ToCmd("dropped"))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		cancel()
+
+		err := <-machine.Errors()
+		s.ErrorIs(err, ErrDropped)
+	})
+}
+
+func (s *Suite) TestWatchdog() {
+	s.Run("should detect a blocking Update", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		stuck := make(chan struct{}, 1)
+		release := make(chan struct{})
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "block").Return(func(Msg) (State, Cmd) {
+			<-release
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state, WithWatchdog(time.Millisecond*50, func() {
+			stuck <- struct{}{}
+		}))
+		start := time.Now()
+		machine.Send(ToCmd("block"))
+
+		select {
+		case <-stuck:
+		case <-time.After(time.Second):
+			s.Fail("the watchdog should have fired")
+		}
+		close(release)
+		s.NoError(machine.WaitIdle(ctx))
+		s.False(machine.LastActivity().Before(start))
+	})
+
+	s.Run("should not fire when idle", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		var fired int32
+		New(ctx, mocks.NewStmState(s.T()), WithWatchdog(time.Millisecond*20, func() {
+			atomic.AddInt32(&fired, 1)
+		}))
+		time.Sleep(time.Millisecond * 100)
+		s.Zero(atomic.LoadInt32(&fired))
+	})
+}
+
+func (s *Suite) TestUpdateTimeout() {
+	s.Run("should report the slow updates", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "slow").Return(func(Msg) (State, Cmd) {
+			time.Sleep(time.Millisecond * 50)
+			return state, nil
+		}).Once()
+		state.On("Update", "fast").Return(state, nil).Once()
+
+		type slow struct {
+			msg     Msg
+			elapsed time.Duration
+		}
+		chSlow := make(chan slow, 2)
+		machine := New(ctx, state, WithUpdateTimeout(time.Millisecond*20, func(msg Msg, elapsed time.Duration) {
+			chSlow <- slow{msg: msg, elapsed: elapsed}
+		}))
+
+		s.NoError(machine.SendSync(ToCmd("fast")))
+		s.NoError(machine.SendSync(ToCmd("slow")))
+
+		reported := <-chSlow
+		s.Equal("slow", reported.msg)
+		s.GreaterOrEqual(reported.elapsed, time.Millisecond*50)
+		s.Empty(chSlow)
+	})
+}
+
+func (s *Suite) TestMaxChainDepth() {
+	s.Run("should stop a self-sustaining chain", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chExceeded := make(chan Msg, 1)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "ping").Return(state, ToCmd("ping"))
+		state.On("Update", ChainLimitExceeded{Depth: 5}).Return(func(msg Msg) (State, Cmd) {
+			chExceeded <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state, WithMaxChainDepth(5))
+		machine.Send(ToCmd("ping"))
+
+		s.Equal(ChainLimitExceeded{Depth: 5}, <-chExceeded)
+		s.NoError(machine.WaitIdle(ctx))
+		// the external message, the 5 chained ones and ChainLimitExceeded
+		state.AssertNumberOfCalls(s.T(), "Update", 7)
+	})
+
+	s.Run("should not limit the external messages", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "ping").Return(state, ToCmd("pong"))
+		state.On("Update", "pong").Return(state, nil)
+		machine := New(ctx, state, WithMaxChainDepth(1))
+
+		for i := 0; i < 5; i++ {
+			s.NoError(machine.SendSync(ToCmd("ping")))
+		}
+		s.NoError(machine.WaitIdle(ctx))
+		state.AssertNumberOfCalls(s.T(), "Update", 10)
+	})
+}
+
+func (s *Suite) TestRestart() {
+	s.Run("should process messages again after a restart", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, mocks.NewStmState(s.T()))
+		cancel()
+		<-machine.Done()
+		s.ErrorIs(machine.SendSync(ToCmd(s.randString())), ErrTerminated)
+
+		ctx, cancel = context.WithCancel(s.ctx)
+		defer cancel()
+		chNotif := make(chan Msg, 1)
+		state := namedState{name: "restarted", chNotif: chNotif}
+		s.NoError(machine.Restart(ctx, state))
+
+		msg := s.randString()
+		machine.Send(ToCmd(msg))
+		s.Equal(msg, <-chNotif)
+		s.Equal(state, machine.State())
+		s.NoError(machine.Err())
+	})
+
+	s.Run("should fail while the machine is running", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, mocks.NewStmState(s.T()))
+		s.ErrorIs(machine.Restart(ctx, mocks.NewStmState(s.T())), ErrRunning)
+	})
+}
+
+func (s *Suite) TestDone() {
+	s.Run("should close Done when the machine is terminated", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, mocks.NewStmState(s.T()))
+
+		select {
+		case <-machine.Done():
+			s.Fail("the machine should be running")
+		default:
+		}
+
+		cancel()
+		select {
+		case <-machine.Done():
+		case <-time.After(time.Second):
+			s.Fail("the machine should be terminated")
+		}
+	})
+}
+
+func (s *Suite) TestInitialCommands() {
+	s.Run("should process the initial messages first", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		state := namedState{name: "a", chNotif: chNotif}
+
+		machine := New(ctx, state, WithInitialCommands(ToCmd("init 1"), nil, ToCmd("init 2")))
+		machine.Send(ToCmd("external"))
+
+		s.Equal("init 1", <-chNotif)
+		s.Equal("init 2", <-chNotif)
+		s.Equal("external", <-chNotif)
+	})
+}
+
+func (s *Suite) TestCancelableTimer() {
+	state := mocks.NewStmState(s.T())
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	machine := New(ctx, state)
+
+	s.Run("should send the message after the duration", func() {
+		chNotif := make(chan Msg, 1)
+		msg := s.randString()
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		cmd, _ := CancelableTimer(time.Millisecond*50, msg)
+		start := time.Now()
+		machine.Send(cmd)
+		s.Equal(msg, <-chNotif)
+		s.True(time.Since(start) >= time.Millisecond*50)
+	})
+
+	s.Run("should send the message each time the command is executed", func() {
+		chNotif := make(chan Msg, 2)
+		msg := s.randString()
+		state.On("Update", msg).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Twice()
+
+		cmd, cancelTimer := CancelableTimer(-time.Second, msg)
+		defer cancelTimer()
+		machine.Send(cmd)
+		machine.Send(cmd)
+		s.Equal(msg, <-chNotif)
+		s.Equal(msg, <-chNotif)
+	})
+
+	s.Run("should not send the message when cancelled", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			cmd, cancelTimer := CancelableTimer(time.Millisecond*50, s.randString())
+			machine.Send(cmd)
+			cancelTimer()
+		})
+
+		timer := time.NewTimer(time.Millisecond * 100)
+		<-timer.C
+	})
+}
+
+func (s *Suite) TestLogger() {
+	s.Run("should log the processed messages", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		chLog := make(chan LogEntry, 2)
+		state := namedState{name: "a", chNotif: chNotif}
+		next := namedState{name: "b", chNotif: chNotif}
+
+		machine := New(ctx, state, WithLogger(LoggerFunc(func(entry LogEntry) {
+			chLog <- entry
+		})))
+
+		machine.Send(ToCmd("stay"))
+		s.Equal(LogEntry{Msg: "stay", From: state, To: state}, <-chLog)
+
+		machine.Send(ToCmd(next))
+		s.Equal(LogEntry{Msg: next, From: state, To: next, Changed: true}, <-chLog)
+	})
+
+	s.Run("should replace the logger and the middlewares at runtime", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		chOld := make(chan LogEntry, 2)
+		chNew := make(chan LogEntry, 2)
+		state := namedState{name: "a", chNotif: chNotif}
+
+		machine := New(ctx, state, WithLogger(LoggerFunc(func(entry LogEntry) {
+			chOld <- entry
+		})))
+
+		s.NoError(machine.SendSync(ToCmd("first")))
+		machine.SetLogger(LoggerFunc(func(entry LogEntry) {
+			chNew <- entry
+		}))
+		machine.SetMiddleware(func(msg Msg) (Msg, bool) {
+			return msg.(string) + " rewritten", true
+		})
+		s.NoError(machine.SendSync(ToCmd("second")))
+
+		s.Equal("first", (<-chOld).Msg)
+		s.Equal("second rewritten", (<-chNew).Msg)
+		s.Empty(chOld)
+	})
+}
+
+func (s *Suite) TestStateDiff() {
+	s.Run("should log and record the diff of the transitions", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chLog := make(chan LogEntry, 2)
+		machine := New(ctx, counterState{Label: "a"},
+			WithStateDiff(FieldDiff),
+			WithHistory(10),
+			WithLogger(LoggerFunc(func(entry LogEntry) {
+				chLog <- entry
+			})))
+
+		s.NoError(machine.SendSync(ToCmd(2)))
+		s.Equal("Count: 0 -> 2", (<-chLog).Diff)
+		s.NoError(machine.SendSync(ToCmd("b")))
+		s.Equal("Label: a -> b", (<-chLog).Diff)
+
+		history := machine.History()
+		s.Len(history, 2)
+		s.Equal("Count: 0 -> 2", history[0].Diff)
+		s.Equal("Label: a -> b", history[1].Diff)
+	})
+
+	s.Run("should not compute a diff by default", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chLog := make(chan LogEntry, 1)
+		machine := New(ctx, counterState{}, WithLogger(LoggerFunc(func(entry LogEntry) {
+			chLog <- entry
+		})))
+
+		s.NoError(machine.SendSync(ToCmd(1)))
+		entry := <-chLog
+		s.True(entry.Changed)
+		s.Empty(entry.Diff)
+	})
+
+	s.Run("should describe the changes of the exported fields", func() {
+		chNotif := make(chan Msg)
+		s.Equal("Count: 1 -> 3, Label: a -> b",
+			FieldDiff(counterState{Count: 1, Label: "a"}, counterState{Count: 3, Label: "b"}))
+		s.Equal("Count: 1 -> 3",
+			FieldDiff(&counterState{Count: 1}, &counterState{Count: 3}))
+		// the unexported fields are ignored
+		s.Empty(FieldDiff(counterState{seen: 1}, counterState{seen: 2}))
+		s.Equal("stm_test.namedState -> state b",
+			FieldDiff(namedState{name: "a", chNotif: chNotif}, stringState{namedState{name: "b", chNotif: chNotif}}))
+	})
+}
+
+func (s *Suite) TestShutdown() {
+	s.Run("should process the buffered messages before terminating", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(s.ctx, state)
+
+		chGate := make(chan interface{})
+		processed := make(chan Msg, 4)
+		record := func(msg Msg) (State, Cmd) {
+			processed <- msg
+			return state, nil
+		}
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		state.On("Update", 1).Return(record).Once()
+		state.On("Update", 2).Return(record).Once()
+		// the commands returned by Update are still executed
+		next := mocks.NewStmState(s.T())
+		next.On("Init").Return(ToCmd("init")).Once()
+		next.On("Update", "init").Return(func(msg Msg) (State, Cmd) {
+			processed <- msg
+			return next, nil
+		}).Once()
+		state.On("Update", 3).Return(func(msg Msg) (State, Cmd) {
+			processed <- msg
+			return TransitionTo(next)
+		}).Once()
+
+		machine.Send(ToCmd("gate"))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		for i := 1; i <= 3; i++ {
+			machine.SendMsg(i)
+		}
+
+		chShutdown := make(chan error)
+		go func() {
+			chShutdown <- machine.Shutdown(s.ctx)
+		}()
+		timer = time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+		close(chGate)
+
+		s.NoError(<-chShutdown)
+		s.Len(processed, 4)
+		s.ErrorIs(machine.Err(), ErrShutdown)
+
+		// the machine is stopped, sends are ignored
+		machine.Send(ToCmd("ignored"))
+	})
+
+	s.Run("should wait for the running commands", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(s.ctx, state)
+
+		chNotif := make(chan Msg, 1)
+		state.On("Update", "late").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine.Send(Timer(time.Millisecond*50, "late"))
+		chShutdown := make(chan error)
+		go func() {
+			chShutdown <- machine.Shutdown(s.ctx)
+		}()
+
+		// the commands sent from outside are ignored while draining
+		s.Eventually(func() bool {
+			return machine.SendSync(ToCmd(nil)) == ErrTerminated
+		}, time.Second, time.Millisecond)
+		machine.Send(ToCmd("ignored"))
+
+		s.NoError(<-chShutdown)
+		s.Equal("late", <-chNotif)
+	})
+
+	s.Run("should stop waiting when the context is done", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(s.ctx, state)
+		machine.Send(Tick(time.Hour, "tick"))
+
+		ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*50)
+		defer cancel()
+		s.ErrorIs(machine.Shutdown(ctx), context.DeadlineExceeded)
+		<-machine.Done()
+		s.ErrorIs(machine.Err(), ErrShutdown)
+	})
+
+	s.Run("should return when the context is done", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(s.ctx, state)
+
+		chGate := make(chan interface{})
+		defer close(chGate)
+		state.On("Update", "gate").Return(func(Msg) (State, Cmd) {
+			<-chGate
+			return state, nil
+		})
+		machine.Send(ToCmd("gate"))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+
+		ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*50)
+		defer cancel()
+		s.ErrorIs(machine.Shutdown(ctx), context.DeadlineExceeded)
+	})
+}
+
+func (s *Suite) TestSendSync() {
+	s.Run("should return once the message is processed", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+
+		for i := 0; i < 3; i++ {
+			s.NoError(machine.SendSync(ToCmd(i)))
+			s.Equal(i, <-chNotif)
+		}
+		s.NoError(machine.SendSync(ToCmd(nil)))
+	})
+
+	s.Run("should fail when the machine is terminated", func() {
+		state := mocks.NewStmState(s.T())
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, state)
+
+		state.On("Update", "cancel").Return(func(Msg) (State, Cmd) {
+			cancel()
+			return state, nil
+		})
+		s.NoError(machine.SendSync(ToCmd("cancel")))
+		<-machine.Done()
+		s.ErrorIs(machine.SendSync(ToCmd(s.randString())), ErrTerminated)
+	})
+
+	s.Run("should wait for the messages of the commands sending over time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+
+		s.NoError(machine.SendSync(Timer(time.Millisecond*10, "timer")))
+		s.Require().Len(chNotif, 1)
+		s.Equal("timer", <-chNotif)
+
+		s.NoError(machine.SendSync(ContextCmd(func(ctx context.Context) Msg {
+			timer := time.NewTimer(time.Millisecond * 10)
+			defer timer.Stop()
+			<-timer.C
+			return "context"
+		})))
+		s.Require().Len(chNotif, 1)
+		s.Equal("context", <-chNotif)
+	})
+
+	s.Run("should fail when the machine is terminated during the command", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		machine := New(ctx, namedState{name: "a", chNotif: make(chan Msg, 1)})
+
+		go cancel()
+		s.ErrorIs(machine.SendSync(Timer(time.Hour, "late")), ErrTerminated)
+	})
+}
+
+func (s *Suite) TestSynchronousDispatch() {
+	s.Run("should deliver the messages in the order they are sent", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 5)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithSynchronousDispatch())
+
+		machine.Send(func() Msg {
+			timer := time.NewTimer(time.Millisecond * 20)
+			<-timer.C
+			return 0
+		})
+		machine.Send(Batch(ToCmd(1), ToCmd(2)))
+		machine.Send(Sequence(ToCmd(3), ToCmd(4)))
+
+		for i := 0; i < 5; i++ {
+			s.Equal(i, <-chNotif)
+		}
+	})
+}
+
+func (s *Suite) TestDeterministicScheduler() {
+	run := func(seed int64) []Msg {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 10)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithDeterministicScheduler(seed))
+
+		cmds := []Cmd{}
+		for i := 0; i < 10; i++ {
+			cmds = append(cmds, ToCmd(i))
+		}
+		machine.Send(Batch(cmds...))
+
+		received := []Msg{}
+		for i := 0; i < 10; i++ {
+			received = append(received, <-chNotif)
+		}
+		return received
+	}
+
+	s.Run("should deliver the messages in the same order for a seed", func() {
+		first := run(42)
+		s.ElementsMatch([]Msg{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, first)
+		for i := 0; i < 5; i++ {
+			s.Equal(first, run(42))
+		}
+	})
+
+	s.Run("should change the order with the seed", func() {
+		orders := map[string]bool{}
+		for seed := int64(0); seed < 5; seed++ {
+			orders[fmt.Sprint(run(seed))] = true
+		}
+		s.Greater(len(orders), 1)
+	})
+
+	s.Run("should not be blocked by the commands sending messages over time", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithDeterministicScheduler(1))
+		machine.Send(Tick(time.Hour, "tick"))
+		machine.Send(ToCmd("msg"))
+		s.Equal("msg", <-chNotif)
+	})
+}
+
+func (s *Suite) TestPump() {
+	pull := func(n int) func() (Msg, bool) {
+		next := 0
+		return func() (Msg, bool) {
+			if next >= n {
+				return nil, false
+			}
+			next++
+			return next, true
+		}
+	}
+
+	s.Run("should send the items in order while the buffer has room", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 20)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithMessageBufferSize(2))
+		machine.Send(Pump(pull(20), nil))
+
+		for i := 1; i <= 20; i++ {
+			s.Equal(i, <-chNotif)
+		}
+		s.Require().NoError(machine.WaitIdle(ctx))
+	})
+
+	s.Run("should wait for the capacity", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		clock := stmtest.NewFakeClock(time.Now())
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif}, WithClock(clock))
+
+		capacity := int32(0)
+		machine.Send(Pump(pull(3), func() bool {
+			return atomic.LoadInt32(&capacity) == 1
+		}))
+		clock.BlockUntil(1)
+		s.Empty(chNotif)
+
+		atomic.StoreInt32(&capacity, 1)
+		clock.Advance(PumpInterval)
+		s.Equal(1, <-chNotif)
+		s.Equal(2, <-chNotif)
+		s.Equal(3, <-chNotif)
+	})
+}
+
+func (s *Suite) TestNestedBatch() {
+	s.Run("should deliver every message of nested batches once", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 5)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(5)
+
+		machine := New(ctx, state)
+		machine.Send(Batch(
+			ToCmd("a"),
+			Batch(
+				ToCmd("b"),
+				Batch(ToCmd("c"), ToCmd("d")),
+			),
+			ToCmd("e"),
+		))
+
+		received := []Msg{}
+		for i := 0; i < 5; i++ {
+			received = append(received, <-chNotif)
+		}
+		s.ElementsMatch([]Msg{"a", "b", "c", "d", "e"}, received)
+		s.NoError(machine.WaitIdle(ctx))
+	})
+}
+
+func (s *Suite) TestFlatten() {
+	s.Run("should deliver the messages depth first", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 5)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(5)
+
+		machine := New(ctx, state)
+		machine.Send(Flatten(
+			ToCmd("a"),
+			Batch(
+				ToCmd("b"),
+				nil,
+				Batch(ToCmd("c"), ToCmd(nil), ToCmd("d")),
+			),
+			ToCmd("e"),
+		))
+
+		for _, msg := range []string{"a", "b", "c", "d", "e"} {
+			s.Equal(msg, <-chNotif)
+		}
+	})
+}
+
+func (s *Suite) TestNilState() {
+	s.Run("should stay in the current state when Update returns nil", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 2)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "nil").Return(nil, ToCmd("cmd")).Once()
+		state.On("Update", "cmd").Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Once()
+
+		machine := New(ctx, state)
+		machine.Send(ToCmd("nil"))
+		s.Equal("cmd", <-chNotif)
+		s.Equal(state, machine.State())
+	})
+}
+
+func (s *Suite) TestSendAfterShutdown() {
+	s.Run("should not leak the commands blocked on a full buffer", func() {
+		stmtest.AssertNoLeaks(s.T(), func() {
+			ctx, cancel := context.WithCancel(s.ctx)
+			defer cancel()
+
+			release := make(chan struct{})
+			state := mocks.NewStmState(s.T())
+			state.On("Update", mock.Anything).Return(func(Msg) (State, Cmd) {
+				<-release
+				return state, nil
+			}).Maybe()
+
+			machine := New(ctx, state, WithMessageBufferSize(1))
+			for i := 0; i < 5; i++ {
+				machine.Send(ToCmd(i))
+			}
+
+			cancel()
+			close(release)
+			<-machine.Done()
+
+			machine.Send(ToCmd("after"))
+		})
+	})
+}
+
+func (s *Suite) TestSendMsg() {
+	s.Run("should deliver the message to Update", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 4)
+		machine := New(ctx, namedState{name: "a", chNotif: chNotif})
+
+		machine.SendMsg(nil)
+		machine.SendMsg("first")
+		machine.SendMsg("second")
+		s.Equal("first", <-chNotif)
+		s.Equal("second", <-chNotif)
+
+		machine.SendMsg(Batch(ToCmd("batched"))())
+		s.Equal("batched", <-chNotif)
+		s.NoError(machine.WaitIdle(ctx))
+		s.Empty(chNotif)
+	})
+}
+
+func (s *Suite) TestStep() {
+	s.Run("should return the same transition as the loop", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 4)
+		state := namedState{name: "a", chNotif: chNotif}
+		next := namedState{name: "b", chNotif: chNotif}
+		machine := New(ctx, state)
+
+		for _, msg := range []Msg{"stay", next} {
+			machine.Pause()
+			stepped, cmd := machine.Step(msg)
+			s.Nil(cmd)
+			s.Equal(state, machine.State())
+			machine.Resume()
+
+			s.NoError(machine.SendSync(ToCmd(msg)))
+			s.Equal(stepped, machine.State())
+		}
+	})
+
+	s.Run("should keep the current state on nil", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		state := mocks.NewStmState(s.T())
+		state.On("Update", "msg").Return(nil, ToCmd("cmd")).Once()
+		machine := New(ctx, state)
+
+		next, cmd := machine.Step("msg")
+		s.Equal(state, next)
+		s.Equal("cmd", cmd())
+	})
+
+	s.Run("should resolve the states of Push and Pop", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		base := mocks.NewStmState(s.T())
+		dialog := mocks.NewStmState(s.T())
+		base.On("Update", "open").Return(func(Msg) (State, Cmd) {
+			return Push(dialog)
+		})
+		dialog.On("Init").Return(nil)
+		dialog.On("Update", "close").Return(func(Msg) (State, Cmd) {
+			return Pop()
+		})
+
+		machine := New(ctx, base)
+		machine.Pause()
+		next, _ := machine.Step("open")
+		s.Equal(dialog, next)
+		machine.Resume()
+
+		s.NoError(machine.SendSync(ToCmd("open")))
+		s.Equal(dialog, machine.State())
+
+		machine.Pause()
+		next, cmd := machine.Step("close")
+		s.Equal(base, next)
+		s.Nil(cmd)
+		machine.Resume()
+
+		s.NoError(machine.SendSync(ToCmd("close")))
+		s.Equal(base, machine.State())
+	})
+}
+
+func (s *Suite) TestNone() {
+	s.Run("should do nothing", func() {
+		s.Nil(None())
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		machine := New(ctx, mocks.NewStmState(s.T()))
+
+		before := runtime.NumGoroutine()
+		for i := 0; i < 10; i++ {
+			machine.Send(None())
+		}
+		s.LessOrEqual(runtime.NumGoroutine(), before)
+		s.NoError(machine.WaitIdle(ctx))
+	})
+}
+
+func (s *Suite) TestOrderedBatch() {
+	s.Run("should deliver the messages in the order of the commands", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan Msg, 3)
+		state := mocks.NewStmState(s.T())
+		state.On("Update", mock.Anything).Return(func(msg Msg) (State, Cmd) {
+			chNotif <- msg
+			return state, nil
+		}).Times(3)
+
+		machine := New(ctx, state)
+		start := time.Now()
+		machine.Send(OrderedBatch(
+			Timer(time.Millisecond*60, "a"),
+			Timer(time.Millisecond*20, "b"),
+			ToCmd(nil),
+			Timer(time.Millisecond*40, "c"),
+		))
+
+		s.Equal("a", <-chNotif)
+		s.Equal("b", <-chNotif)
+		s.Equal("c", <-chNotif)
+		// the commands run concurrently
+		s.Less(time.Since(start), time.Millisecond*120)
+	})
+}
+
+func (s *Suite) TestQuit() {
+	s.Run("should terminate the machine from a state", func() {
+		state := mocks.NewStmState(s.T())
+		machine := New(s.ctx, state)
+
+		state.On("Update", "quit").Return(func(Msg) (State, Cmd) {
+			return state, Quit()
+		}).Once()
+
+		machine.Send(ToCmd("quit"))
+		select {
+		case <-machine.Done():
+		case <-time.After(time.Second):
+			s.Fail("the machine should be terminated")
+		}
+		s.ErrorIs(machine.Err(), ErrQuit)
+
+		// the mock fails on unexpected messages
+		machine.Send(ToCmd(s.randString()))
+		timer := time.NewTimer(time.Millisecond * 50)
+		<-timer.C
+	})
+}
@@ -0,0 +1,141 @@
+package stmtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fdelbos/stm"
+)
+
+type (
+	// FakeClock is a stm.Clock whose time only moves with Advance, to test
+	// the timers of a state machine without waiting. Set it with
+	// stm.WithClock.
+	FakeClock struct {
+		mu      sync.Mutex
+		changed *sync.Cond
+		now     time.Time
+		timers  []*fakeTimer
+	}
+
+	// fakeTimer is a timer, or a ticker when period > 0, of a FakeClock.
+	fakeTimer struct {
+		clock    *FakeClock
+		deadline time.Time
+		period   time.Duration
+		ch       chan time.Time
+	}
+
+	fakeTicker struct {
+		*fakeTimer
+	}
+)
+
+// NewFakeClock creates a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.changed = sync.NewCond(&clock.mu)
+	return clock
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer firing once the clock is advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) stm.ClockTimer {
+	return c.add(d, 0)
+}
+
+// NewTicker creates a ticker firing each time the clock is advanced by d.
+func (c *FakeClock) NewTicker(d time.Duration) stm.ClockTicker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := &fakeTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		period:   period,
+		ch:       make(chan time.Time, 1),
+	}
+	c.timers = append(c.timers, timer)
+	c.changed.Broadcast()
+	return timer
+}
+
+// Advance moves the time of the clock forward by d and fires the timers and
+// tickers reaching their deadline. As with the time package, a ticker drops
+// the ticks while its channel is full.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	active := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			active = append(active, timer)
+			continue
+		}
+
+		select {
+		case timer.ch <- c.now:
+		default:
+		}
+		if timer.period > 0 {
+			for !timer.deadline.After(c.now) {
+				timer.deadline = timer.deadline.Add(timer.period)
+			}
+			active = append(active, timer)
+		}
+	}
+	c.timers = active
+	c.changed.Broadcast()
+}
+
+// BlockUntil waits until at least n timers and tickers are waiting for the
+// clock to advance. Call it before Advance to make sure the commands of the
+// state machine created their timers.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.changed.Wait()
+	}
+}
+
+// remove stops the timer, it returns false if it already fired or was
+// stopped.
+func (c *FakeClock) remove(timer *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+func (t fakeTicker) Stop() {
+	t.clock.remove(t.fakeTimer)
+}
@@ -0,0 +1,56 @@
+package stmtest_test
+
+import (
+	"time"
+
+	. "github.com/fdelbos/stm/stmtest"
+)
+
+func (s *Suite) TestFakeClock() {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s.Run("should only move with Advance", func() {
+		clock := NewFakeClock(start)
+		s.Equal(start, clock.Now())
+		clock.Advance(time.Minute)
+		s.Equal(start.Add(time.Minute), clock.Now())
+	})
+
+	s.Run("should fire the timers at their deadline", func() {
+		clock := NewFakeClock(start)
+		timer := clock.NewTimer(time.Minute)
+
+		clock.Advance(time.Second * 59)
+		s.Empty(timer.C())
+
+		clock.Advance(time.Second)
+		s.Equal(start.Add(time.Minute), <-timer.C())
+		s.False(timer.Stop())
+	})
+
+	s.Run("should fire the tickers at each period", func() {
+		clock := NewFakeClock(start)
+		ticker := clock.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		clock.Advance(time.Minute)
+		s.Equal(start.Add(time.Minute), <-ticker.C())
+		clock.Advance(time.Minute)
+		s.Equal(start.Add(time.Minute*2), <-ticker.C())
+	})
+
+	s.Run("should not fire the stopped timers", func() {
+		clock := NewFakeClock(start)
+		timer := clock.NewTimer(time.Minute)
+		s.True(timer.Stop())
+
+		clock.Advance(time.Hour)
+		s.Empty(timer.C())
+	})
+
+	s.Run("should wait for the timers", func() {
+		clock := NewFakeClock(start)
+		go clock.NewTimer(time.Minute)
+		clock.BlockUntil(1)
+	})
+}
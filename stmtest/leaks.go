@@ -0,0 +1,36 @@
+// Package stmtest provides helpers to test state machines.
+package stmtest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// LeakTimeout is the time given to the goroutines started by a scenario to
+// exit before AssertNoLeaks reports them as leaked.
+var LeakTimeout = time.Second
+
+// AssertNoLeaks runs the given scenario and fails the test if the number of
+// goroutines is still higher than before the scenario after LeakTimeout. The
+// scenario must terminate the state machines it creates. As the check is
+// based on the number of goroutines, tests using it should not run in
+// parallel.
+func AssertNoLeaks(t testing.TB, scenario func()) {
+	t.Helper()
+
+	before := runtime.NumGoroutine()
+	scenario()
+
+	deadline := time.Now().Add(LeakTimeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Errorf("stmtest: %d goroutine(s) leaked:\n%s",
+				runtime.NumGoroutine()-before, buf)
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
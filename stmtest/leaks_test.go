@@ -0,0 +1,56 @@
+package stmtest_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/fdelbos/stm/stmtest"
+	"github.com/stretchr/testify/suite"
+)
+
+type Suite struct {
+	suite.Suite
+}
+
+func TestSuite(t *testing.T) {
+	suite.Run(t, &Suite{})
+}
+
+// recorder is a testing.TB recording failures.
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(string, ...interface{}) {
+	r.failed = true
+}
+
+func (s *Suite) TestAssertNoLeaks() {
+	timeout := LeakTimeout
+	LeakTimeout = time.Millisecond * 100
+	defer func() { LeakTimeout = timeout }()
+
+	s.Run("should pass when goroutines exit", func() {
+		t := &recorder{TB: s.T()}
+		AssertNoLeaks(t, func() {
+			done := make(chan interface{})
+			go func() { <-done }()
+			close(done)
+		})
+		s.False(t.failed)
+	})
+
+	s.Run("should fail when a goroutine leaks", func() {
+		t := &recorder{TB: s.T()}
+		done := make(chan interface{})
+		defer close(done)
+
+		AssertNoLeaks(t, func() {
+			go func() { <-done }()
+		})
+		s.True(t.failed)
+	})
+}
@@ -0,0 +1,93 @@
+package stm
+
+import "reflect"
+
+type (
+	// Handler handles a message for a TableState.
+	Handler func(Msg) (State, Cmd)
+
+	// TableState is a state dispatching the messages to handlers registered
+	// by message type, as a declarative alternative to a type switch in
+	// Update. A message is given to the handler of its type, or else to the
+	// handler of the first registered interface it implements, or else to
+	// the default handler. It is ignored when there is none. Handlers must be
+	// registered before the state is given to a state machine.
+	TableState struct {
+		init       Cmd
+		handlers   map[reflect.Type]Handler
+		interfaces []interfaceHandler
+		fallback   Handler
+	}
+
+	// interfaceHandler is a handler registered with OnInterface.
+	interfaceHandler struct {
+		iface   reflect.Type
+		handler Handler
+	}
+)
+
+// NewTableState creates a TableState without handlers.
+func NewTableState() *TableState {
+	return &TableState{
+		handlers: map[reflect.Type]Handler{},
+	}
+}
+
+// On registers the handler of the messages of the same type as msgType, a
+// zero value of the type is enough: tbl.On(Start{}, handler). Registering a
+// handler for a type replaces the previous one.
+func (t *TableState) On(msgType Msg, handler Handler) *TableState {
+	t.handlers[reflect.TypeOf(msgType)] = handler
+	return t
+}
+
+// OnInterface registers the handler of the messages implementing an
+// interface, given as a nil pointer to the interface:
+// tbl.OnInterface((*error)(nil), handler). Interfaces are matched in the
+// order they are registered, after the handlers registered with On. It panics
+// if iface is not a pointer to an interface.
+func (t *TableState) OnInterface(iface interface{}, handler Handler) *TableState {
+	typ := reflect.TypeOf(iface)
+	if typ == nil || typ.Kind() != reflect.Pointer || typ.Elem().Kind() != reflect.Interface {
+		panic("stm: OnInterface expects a pointer to an interface")
+	}
+	t.interfaces = append(t.interfaces, interfaceHandler{iface: typ.Elem(), handler: handler})
+	return t
+}
+
+// Default registers the handler of the messages without a handler.
+func (t *TableState) Default(handler Handler) *TableState {
+	t.fallback = handler
+	return t
+}
+
+// OnInit sets the command returned by Init.
+func (t *TableState) OnInit(cmd Cmd) *TableState {
+	t.init = cmd
+	return t
+}
+
+func (t *TableState) Init() Cmd {
+	return t.init
+}
+
+// Update gives the message to the handler of its type, of an interface it
+// implements, or to the default handler. Without handler the state stays the
+// same.
+func (t *TableState) Update(msg Msg) (State, Cmd) {
+	typ := reflect.TypeOf(msg)
+	if handler, ok := t.handlers[typ]; ok {
+		return handler(msg)
+	}
+	if typ != nil {
+		for _, h := range t.interfaces {
+			if typ.Implements(h.iface) {
+				return h.handler(msg)
+			}
+		}
+	}
+	if t.fallback != nil {
+		return t.fallback(msg)
+	}
+	return t, nil
+}
@@ -0,0 +1,92 @@
+package stm_test
+
+import (
+	"errors"
+
+	. "github.com/fdelbos/stm"
+)
+
+type (
+	tableStart struct{}
+	tableStop  struct{ reason string }
+)
+
+func (s *Suite) TestTableState() {
+	next := namedState{name: "next"}
+
+	newTable := func() *TableState {
+		tbl := NewTableState()
+		return tbl.
+			On(tableStart{}, func(Msg) (State, Cmd) {
+				return tbl, ToCmd("started")
+			}).
+			On(tableStop{}, func(msg Msg) (State, Cmd) {
+				return next, ToCmd(msg.(tableStop).reason)
+			})
+	}
+
+	s.Run("should dispatch by message type", func() {
+		tbl := newTable()
+
+		state, cmd := tbl.Update(tableStart{})
+		s.Equal(tbl, state)
+		s.Equal("started", cmd())
+
+		state, cmd = tbl.Update(tableStop{reason: "done"})
+		s.Equal(next, state)
+		s.Equal("done", cmd())
+	})
+
+	s.Run("should stay in place without handler", func() {
+		tbl := newTable()
+		state, cmd := tbl.Update(s.randString())
+		s.Equal(tbl, state)
+		s.Nil(cmd)
+	})
+
+	s.Run("should use the default handler", func() {
+		tbl := newTable().Default(func(msg Msg) (State, Cmd) {
+			return next, ToCmd(msg)
+		})
+		msg := s.randString()
+		state, cmd := tbl.Update(msg)
+		s.Equal(next, state)
+		s.Equal(msg, cmd())
+	})
+
+	s.Run("should dispatch by interface", func() {
+		tbl := newTable().
+			OnInterface((*error)(nil), func(msg Msg) (State, Cmd) {
+				return next, ToCmd("error")
+			}).
+			Default(func(msg Msg) (State, Cmd) {
+				return next, ToCmd("default")
+			})
+
+		_, cmd := tbl.Update(ErrMsg{Err: errors.New(s.randString())})
+		s.Equal("error", cmd())
+
+		// the concrete type takes precedence
+		tbl.On(ErrMsg{}, func(Msg) (State, Cmd) {
+			return next, ToCmd("concrete")
+		})
+		_, cmd = tbl.Update(ErrMsg{Err: errors.New(s.randString())})
+		s.Equal("concrete", cmd())
+
+		_, cmd = tbl.Update(s.randString())
+		s.Equal("default", cmd())
+		_, cmd = tbl.Update(nil)
+		s.Equal("default", cmd())
+	})
+
+	s.Run("should panic when not given an interface", func() {
+		s.Panics(func() {
+			NewTableState().OnInterface(tableStart{}, nil)
+		})
+	})
+
+	s.Run("should return the init command", func() {
+		s.Nil(NewTableState().Init())
+		s.Equal("init", NewTableState().OnInit(ToCmd("init")).Init()())
+	})
+}
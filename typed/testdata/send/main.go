@@ -0,0 +1,26 @@
+// Command send is built by the tests of the typed package to check that the
+// messages sent to a state machine are type checked. The line sending a
+// string is only compiled with the wrongtype build tag.
+package main
+
+import (
+	"context"
+
+	"github.com/fdelbos/stm/typed"
+)
+
+type counter struct{}
+
+func (c counter) Init() typed.Cmd[int] {
+	return typed.Cmd[int]{}
+}
+
+func (c counter) Update(int) (typed.State[int], typed.Cmd[int]) {
+	return c, typed.Cmd[int]{}
+}
+
+func main() {
+	machine := typed.New[int](context.Background(), counter{})
+	machine.Send(typed.ToCmd(1))
+	sendWrongType(machine)
+}
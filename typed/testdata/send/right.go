@@ -0,0 +1,7 @@
+//go:build !wrongtype
+
+package main
+
+import "github.com/fdelbos/stm/typed"
+
+func sendWrongType(*typed.Stm[int]) {}
@@ -0,0 +1,9 @@
+//go:build wrongtype
+
+package main
+
+import "github.com/fdelbos/stm/typed"
+
+func sendWrongType(machine *typed.Stm[int]) {
+	machine.Send(typed.ToCmd("1"))
+}
@@ -0,0 +1,117 @@
+// Package typed provides a state machine whose messages are all of the same
+// type, checked at compile time. It is built on top of the untyped state
+// machine of the stm package.
+package typed
+
+import (
+	"context"
+
+	"github.com/fdelbos/stm"
+)
+
+type (
+	// Cmd is a command producing messages of type M. The zero value is a
+	// command that does nothing. Build commands with Func, ToCmd and Batch.
+	Cmd[M any] struct {
+		cmd stm.Cmd
+	}
+
+	// State is a state of a state machine whose messages are of type M.
+	State[M any] interface {
+		// Update is called when a message is received by the state machine.
+		// It returns the next state and a command to execute.
+		Update(M) (State[M], Cmd[M])
+
+		// Init is called when the state is entered with TransitionTo.
+		Init() Cmd[M]
+	}
+
+	// Stm is a state machine whose messages are of type M.
+	Stm[M any] struct {
+		stm *stm.Stm
+	}
+
+	// adapter turns a State into an untyped stm.State.
+	adapter[M any] struct {
+		state State[M]
+	}
+)
+
+// Func returns a command executing fn. fn returns false when there is no
+// message to send.
+func Func[M any](fn func() (M, bool)) Cmd[M] {
+	return Cmd[M]{cmd: func() stm.Msg {
+		msg, ok := fn()
+		if !ok {
+			return nil
+		}
+		return msg
+	}}
+}
+
+// ToCmd returns a command that will send the given message immediately.
+func ToCmd[M any](msg M) Cmd[M] {
+	return Cmd[M]{cmd: stm.ToCmd(msg)}
+}
+
+// Batch returns a command that will execute the given list of commands.
+func Batch[M any](cmds ...Cmd[M]) Cmd[M] {
+	untyped := make([]stm.Cmd, 0, len(cmds))
+	for _, cmd := range cmds {
+		untyped = append(untyped, cmd.cmd)
+	}
+	return Cmd[M]{cmd: stm.Batch(untyped...)}
+}
+
+// TransitionTo returns the given state and a command executing its Init
+// command followed by the given commands, see stm.TransitionTo.
+func TransitionTo[M any](state State[M], cmds ...Cmd[M]) (State[M], Cmd[M]) {
+	untyped := make([]stm.Cmd, 0, len(cmds))
+	for _, cmd := range cmds {
+		untyped = append(untyped, cmd.cmd)
+	}
+	_, cmd := stm.TransitionTo(adapter[M]{state: state}, untyped...)
+	return state, Cmd[M]{cmd: cmd}
+}
+
+// New creates and starts a state machine with the initial state and options.
+// The state machine will be terminated when the context is done.
+func New[M any](ctx context.Context, initialState State[M], opts ...stm.StmOptions) *Stm[M] {
+	return &Stm[M]{
+		stm: stm.New(ctx, adapter[M]{state: initialState}, opts...),
+	}
+}
+
+// Send a command to the state machine.
+func (s *Stm[M]) Send(cmd Cmd[M]) {
+	s.stm.Send(cmd.cmd)
+}
+
+// State returns the current state of the state machine.
+func (s *Stm[M]) State() State[M] {
+	return s.stm.State().(adapter[M]).state
+}
+
+// Done returns a channel that is closed once the state machine is terminated.
+func (s *Stm[M]) Done() <-chan struct{} {
+	return s.stm.Done()
+}
+
+func (a adapter[M]) Init() stm.Cmd {
+	return a.state.Init().cmd
+}
+
+// Update ignores the messages that are not of type M, like the messages
+// produced by some options of the untyped state machine. A nil state returned
+// by the typed state keeps the current state, as with the untyped one.
+func (a adapter[M]) Update(msg stm.Msg) (stm.State, stm.Cmd) {
+	m, ok := msg.(M)
+	if !ok {
+		return a, nil
+	}
+	next, cmd := a.state.Update(m)
+	if next == nil {
+		return a, cmd.cmd
+	}
+	return adapter[M]{state: next}, cmd.cmd
+}
@@ -0,0 +1,129 @@
+package typed_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	. "github.com/fdelbos/stm/typed"
+	"github.com/stretchr/testify/suite"
+)
+
+type Suite struct {
+	suite.Suite
+
+	ctx context.Context
+}
+
+func TestSuite(t *testing.T) {
+	suite.Run(t, &Suite{})
+}
+
+func (s *Suite) SetupTest() {
+	s.ctx = context.Background()
+}
+
+// counter sums the received integers and notifies every total. Sending a
+// message of another type, like machine.Send(ToCmd("1")), doesn't compile,
+// see TestTypeCheck.
+type counter struct {
+	total   int
+	chNotif chan int
+}
+
+func (c counter) Init() Cmd[int] {
+	return Cmd[int]{}
+}
+
+func (c counter) Update(msg int) (State[int], Cmd[int]) {
+	c.total += msg
+	c.chNotif <- c.total
+	return c, Cmd[int]{}
+}
+
+// recorder notifies the received messages and keeps its state by returning
+// nil.
+type recorder struct {
+	chNotif chan string
+}
+
+func (r recorder) Init() Cmd[string] {
+	return Cmd[string]{}
+}
+
+func (r recorder) Update(msg string) (State[string], Cmd[string]) {
+	r.chNotif <- msg
+	return nil, Cmd[string]{}
+}
+
+func (s *Suite) TestTyped() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	chNotif := make(chan int, 3)
+	machine := New[int](ctx, counter{chNotif: chNotif})
+
+	s.Run("should send typed messages", func() {
+		machine.Send(ToCmd(2))
+		s.Equal(2, <-chNotif)
+		s.Eventually(func() bool {
+			return machine.State().(counter).total == 2
+		}, time.Second, time.Millisecond)
+	})
+
+	s.Run("should send a batch of messages", func() {
+		machine.Send(Batch(ToCmd(1), ToCmd(1)))
+		<-chNotif
+		s.Equal(4, <-chNotif)
+	})
+
+	s.Run("should not send anything when a command has no message", func() {
+		machine.Send(Func(func() (int, bool) {
+			return 0, false
+		}))
+		machine.Send(Cmd[int]{})
+		machine.Send(ToCmd(3))
+		s.Equal(7, <-chNotif)
+	})
+}
+
+func (s *Suite) TestNilState() {
+	s.Run("should keep the current state", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		chNotif := make(chan string, 2)
+		machine := New[string](ctx, recorder{chNotif: chNotif})
+
+		machine.Send(ToCmd("first"))
+		s.Equal("first", <-chNotif)
+		machine.Send(ToCmd("second"))
+		s.Equal("second", <-chNotif)
+		s.Equal(recorder{chNotif: chNotif}, machine.State())
+	})
+}
+
+func (s *Suite) TestTypeCheck() {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		s.T().Skip("the go command is required to build testdata/send")
+	}
+	build := func(tags string) (string, error) {
+		out, err := exec.Command(gobin, "build", "-tags", tags, "-o", os.DevNull, "./testdata/send").CombinedOutput()
+		return string(out), err
+	}
+
+	s.Run("should compile the messages of the type of the machine", func() {
+		out, err := build("")
+		s.NoError(err, out)
+	})
+
+	s.Run("should not compile the messages of another type", func() {
+		out, err := build("wrongtype")
+		s.Error(err)
+		s.Contains(out, "wrong.go:8")
+		s.Contains(out, "as typed.Cmd[int] value in argument to machine.Send")
+	})
+}